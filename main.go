@@ -11,7 +11,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/flashbots/prio-load-balancer/server"
 	"github.com/flashbots/prio-load-balancer/testutils"
 	"go.uber.org/zap"
@@ -40,6 +40,7 @@ var (
 	useMockNodePtr = flag.Bool("mock-node", false, "run a mock node backend")
 	logProdPtr     = flag.Bool("log-prod", defaultlogProd, "production logging")
 	logServicePtr  = flag.String("log-service", defaultLogService, "'service' tag to logs")
+	adminAddrPtr   = flag.String("admin-http", server.AdminListenAddr, "admin http service address for /nodes, /apikeys, /metrics and debug APIs (empty to serve them on the public address)")
 )
 
 func perr(err error) {
@@ -72,6 +73,8 @@ func main() {
 		*redisPtr = redisServer.Addr()
 	}
 
+	server.AdminListenAddr = *adminAddrPtr
+
 	serverOpts := server.ServerOpts{
 		Log:            log,
 		RedisURI:       *redisPtr,
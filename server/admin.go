@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+type adminActorKey struct{}
+
+// AdminActor returns who made an admin API request: the client certificate's common name, "token" for the
+// admin token, or "anonymous" if the admin API isn't authenticated. Empty if it's not an admin request.
+func AdminActor(ctx context.Context) string {
+	actor, _ := ctx.Value(adminActorKey{}).(string)
+	return actor
+}
+
+// adminAuthEnabled returns whether the admin API requires a token or a client certificate
+func adminAuthEnabled() bool {
+	return AdminToken != "" || AdminTLSClientCAFile != ""
+}
+
+// adminActor authenticates an admin request, with the admin token (bearer token) or a client certificate
+// verified against the admin client CA. Returns false if the request is not authenticated.
+func adminActor(req *http.Request) (actor string, ok bool) {
+	if !adminAuthEnabled() {
+		return "anonymous", true
+	}
+	if AdminTLSClientCAFile != "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if AdminToken != "" {
+		token := requestAPIKey(req.Header) // same as API keys: bearer token or X-API-Key header
+		if subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1 {
+			return "token", true
+		}
+	}
+	return "", false
+}
+
+// adminMiddleware authenticates admin requests, and writes an audit log entry for every mutation
+func (s *Webserver) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		actor, ok := adminActor(req)
+		if !ok {
+			s.log.Warnw("Unauthorized admin request", "method", req.Method, "path", req.URL.EscapedPath(), "remoteAddr", req.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), adminActorKey{}, actor))
+
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		wrapped := wrapResponseWriter(w)
+		next.ServeHTTP(wrapped, req)
+		status := wrapped.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.log.Infow("Admin audit",
+			"actor", actor,
+			"remoteAddr", req.RemoteAddr,
+			"method", req.Method,
+			"path", req.URL.EscapedPath(),
+			"payload", auditPayload(body),
+			"status", status,
+		)
+	})
+}
+
+// auditPayload returns the request payload for the audit log, with API keys masked
+func auditPayload(body []byte) string {
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return string(body)
+	}
+	if key, ok := payload["key"].(string); ok {
+		payload["key"] = maskAPIKey(key)
+	}
+	masked, err := json.Marshal(payload)
+	if err != nil {
+		return string(body)
+	}
+	return string(masked)
+}
+
+// adminTLSConfig returns the TLS config of the admin listener. With a client CA, client certificates are
+// verified if given (the admin token is accepted as well).
+func adminTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if AdminTLSClientCAFile == "" {
+		return config, nil
+	}
+
+	caCert, err := os.ReadFile(AdminTLSClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading admin client CA failed")
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("admin client CA contains no certificates")
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// ValidateAdminConfig checks that the admin listener settings fit together
+func ValidateAdminConfig() error {
+	if (AdminTLSCertFile == "") != (AdminTLSKeyFile == "") {
+		return errors.New("ADMIN_TLS_CERT_FILE and ADMIN_TLS_KEY_FILE need to be set together")
+	}
+	if AdminTLSClientCAFile != "" && (AdminListenAddr == "" || AdminTLSCertFile == "") {
+		return errors.New("ADMIN_TLS_CLIENT_CA_FILE requires ADMIN_LISTEN_ADDR and ADMIN_TLS_CERT_FILE")
+	}
+	if AdminTLSCertFile != "" && AdminListenAddr == "" {
+		return errors.New("ADMIN_TLS_CERT_FILE requires ADMIN_LISTEN_ADDR")
+	}
+	_, err := adminTLSConfig()
+	return err
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminListener(t *testing.T) {
+	defer func(addr, token string) { AdminListenAddr, AdminToken = addr, token }(AdminListenAddr, AdminToken)
+	AdminListenAddr = "localhost:12346"
+	AdminToken = "secret"
+
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), NewNodePool(testLog, nil, 1))
+	public, admin := webserver.Routers()
+
+	// The public listener serves only proxy traffic
+	rr := httptest.NewRecorder()
+	public.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	// The admin API needs the token
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes", nil))
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/nodes", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	admin.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	admin.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"key":"builder-key","client":"builder"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	admin.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NotNil(t, webserver.apiKeys.Get("builder-key"))
+}
+
+func TestAdminOnPublicListener(t *testing.T) {
+	defer func(addr, token string) { AdminListenAddr, AdminToken = addr, token }(AdminListenAddr, AdminToken)
+	AdminListenAddr = ""
+	AdminToken = ""
+
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), NewNodePool(testLog, nil, 1))
+	public, admin := webserver.Routers()
+	require.Equal(t, public, admin)
+
+	rr := httptest.NewRecorder()
+	public.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestAuditPayload(t *testing.T) {
+	require.Equal(t, `{"client":"builder","key":"buil****"}`, auditPayload([]byte(`{"key":"builder-key","client":"builder"}`)))
+	require.Equal(t, `{"uri":"http://localhost:8095"}`, auditPayload([]byte(`{"uri":"http://localhost:8095"}`)))
+	require.Equal(t, `invalid`, auditPayload([]byte(`invalid`)))
+}
+
+func TestValidateAdminConfig(t *testing.T) {
+	defer func(addr, cert, key, ca string) {
+		AdminListenAddr, AdminTLSCertFile, AdminTLSKeyFile, AdminTLSClientCAFile = addr, cert, key, ca
+	}(AdminListenAddr, AdminTLSCertFile, AdminTLSKeyFile, AdminTLSClientCAFile)
+
+	AdminListenAddr, AdminTLSCertFile, AdminTLSKeyFile, AdminTLSClientCAFile = "", "", "", ""
+	require.Nil(t, ValidateAdminConfig())
+
+	AdminTLSCertFile = "cert.pem"
+	require.NotNil(t, ValidateAdminConfig())
+	AdminTLSKeyFile = "key.pem"
+	require.NotNil(t, ValidateAdminConfig())
+	AdminListenAddr = "localhost:12346"
+	require.Nil(t, ValidateAdminConfig())
+
+	AdminTLSClientCAFile = "does-not-exist.pem"
+	require.NotNil(t, ValidateAdminConfig())
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// AdmissionController sheds load when a standing queue builds up (similar to CoDel): if the lowest queue
+// sojourn time within an interval is above the target, the requests are not just bursts but the queue doesn't
+// drain anymore. Then the lowest priority class is shed for the next interval, and one more class for every
+// further interval above the target (but never the highest priority class). An interval without any dequeued
+// request while the queue is not empty counts as above the target (the queue is stalled). Once the sojourn
+// time is back below the target, the classes are admitted again one per interval.
+type AdmissionController struct {
+	lock sync.Mutex
+
+	target     time.Duration
+	interval   time.Duration
+	numClasses int
+	queueLen   func() int // number of queued requests
+
+	intervalStart time.Time
+	minSojourn    time.Duration // lowest sojourn time in the current interval, -1 if there was no sample
+	sheddingLevel int           // number of lowest priority classes which are shed
+}
+
+// NewAdmissionController returns a controller for a queue with numClasses classes, or nil if target is 0
+func NewAdmissionController(target, interval time.Duration, numClasses int, queueLen func() int) *AdmissionController {
+	if target == 0 {
+		return nil
+	}
+	return &AdmissionController{
+		target:        target,
+		interval:      interval,
+		numClasses:    numClasses,
+		queueLen:      queueLen,
+		intervalStart: time.Now(),
+		minSojourn:    -1,
+	}
+}
+
+// update evaluates all intervals which are over. Requires the lock.
+func (a *AdmissionController) update(now time.Time) {
+	if now.Sub(a.intervalStart) < a.interval {
+		return
+	}
+
+	queued := a.queueLen != nil && a.queueLen() > 0
+	for i := 0; now.Sub(a.intervalStart) >= a.interval; i++ {
+		// Intervals without samples all have the same result, after numClasses of them the level doesn't change anymore
+		if i >= a.numClasses {
+			a.intervalStart = now.Add(-now.Sub(a.intervalStart) % a.interval)
+			break
+		}
+
+		if a.minSojourn > a.target || (a.minSojourn == -1 && queued) {
+			if a.sheddingLevel < a.numClasses-1 {
+				a.sheddingLevel += 1
+			}
+		} else if a.sheddingLevel > 0 {
+			a.sheddingLevel -= 1
+		}
+		a.intervalStart = a.intervalStart.Add(a.interval)
+		a.minSojourn = -1
+	}
+	metricAdmissionSheddingLevel.Set(float64(a.sheddingLevel))
+}
+
+// RecordSojourn records how long a request waited in the queue
+func (a *AdmissionController) RecordSojourn(sojourn time.Duration) {
+	if a == nil {
+		return
+	}
+
+	a.recordSojourn(time.Now(), sojourn)
+}
+
+func (a *AdmissionController) recordSojourn(now time.Time, sojourn time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.update(now)
+	if a.minSojourn == -1 || sojourn < a.minSojourn {
+		a.minSojourn = sojourn
+	}
+}
+
+// Admit returns whether a request of the class with the given index (0 is the highest priority) may be queued
+func (a *AdmissionController) Admit(classIndex int) bool {
+	if a == nil {
+		return true
+	}
+
+	return a.admit(time.Now(), classIndex)
+}
+
+func (a *AdmissionController) admit(now time.Time, classIndex int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.update(now)
+	return classIndex < a.numClasses-a.sheddingLevel
+}
+
+// RetryAfter returns how long clients of shed requests should wait before retrying, in seconds
+func (a *AdmissionController) RetryAfter() int {
+	if a == nil || a.interval < time.Second {
+		return 1
+	}
+	return int((a.interval + time.Second - 1) / time.Second)
+}
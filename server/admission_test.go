@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionController(t *testing.T) {
+	require.Nil(t, NewAdmissionController(0, time.Second, 3, nil))
+	var nilController *AdmissionController
+	require.True(t, nilController.Admit(2))
+
+	queueLen := 0
+	a := NewAdmissionController(10*time.Millisecond, 20*time.Millisecond, 3, func() int { return queueLen })
+	require.Equal(t, 1, a.RetryAfter())
+	now := a.intervalStart
+	nextInterval := func() {
+		now = now.Add(20 * time.Millisecond)
+	}
+	overloadedInterval := func() {
+		a.recordSojourn(now, 50*time.Millisecond)
+		nextInterval()
+	}
+
+	// Short bursts don't shed requests
+	a.recordSojourn(now, 50*time.Millisecond)
+	a.recordSojourn(now, time.Millisecond)
+	nextInterval()
+	require.True(t, a.admit(now, 2))
+
+	// Standing queue sheds the lowest priority class first, but never the highest priority one
+	overloadedInterval()
+	require.False(t, a.admit(now, 2))
+	require.True(t, a.admit(now, 1))
+	overloadedInterval()
+	require.False(t, a.admit(now, 1))
+	require.True(t, a.admit(now, 0))
+	overloadedInterval()
+	require.True(t, a.admit(now, 0))
+
+	// Classes are admitted again once the queue delay is below the target
+	a.recordSojourn(now, time.Millisecond)
+	nextInterval()
+	require.True(t, a.admit(now, 1))
+	require.False(t, a.admit(now, 2))
+	nextInterval()
+	require.True(t, a.admit(now, 2))
+}
+
+func TestAdmissionControllerStalledQueue(t *testing.T) {
+	queueLen := 0
+	a := NewAdmissionController(10*time.Millisecond, 20*time.Millisecond, 3, func() int { return queueLen })
+	start := a.intervalStart
+	now := start
+
+	// Intervals without dequeues are below the target if the queue is empty
+	now = now.Add(50 * time.Millisecond)
+	require.True(t, a.admit(now, 2))
+
+	// ... but above the target if requests are queued, and every elapsed interval counts
+	queueLen = 5
+	now = now.Add(40 * time.Millisecond)
+	require.False(t, a.admit(now, 1))
+	require.True(t, a.admit(now, 0))
+
+	// Long idle periods are evaluated without looping over every interval
+	queueLen = 0
+	now = now.Add(time.Hour)
+	require.True(t, a.admit(now, 2))
+	require.True(t, now.Sub(a.intervalStart) < 20*time.Millisecond)
+	require.Equal(t, time.Duration(0), a.intervalStart.Sub(start)%(20*time.Millisecond))
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// APIKeyConfig maps an API key to a client and its quotas, as accepted by the API and persisted in Redis
+type APIKeyConfig struct {
+	Key           string   `json:"key"`
+	Client        string   `json:"client"`                  // client name, used as client ID for fair queuing and in the logs
+	Queues        []string `json:"queues,omitempty"`        // queue classes the key may use (i.e. fast-track), empty allows all
+	RateLimit     float64  `json:"rateLimit,omitempty"`     // max requests per second (with bursts of one second), 0 means no limit
+	MaxConcurrent int32    `json:"maxConcurrent,omitempty"` // max concurrent requests, 0 means no limit
+}
+
+// APIKey is an API key with the state of its quotas
+type APIKey struct {
+	APIKeyConfig
+	rateLimiter *tokenBucket
+	inFlight    atomic.Int32
+}
+
+func newAPIKey(config APIKeyConfig) *APIKey {
+	key := &APIKey{APIKeyConfig: config}
+	if config.RateLimit > 0 {
+		key.rateLimiter = newTokenBucket(config.RateLimit, math.Max(1, config.RateLimit))
+	}
+	return key
+}
+
+// AllowsQueue returns true if the key may use the queue class
+func (k *APIKey) AllowsQueue(queue string) bool {
+	return len(k.Queues) == 0 || containsString(k.Queues, queue)
+}
+
+// Acquire checks the rate and concurrency quotas, and counts the request as in flight until Release is called
+func (k *APIKey) Acquire() bool {
+	if k.MaxConcurrent > 0 {
+		if k.inFlight.Add(1) > k.MaxConcurrent {
+			k.inFlight.Add(-1)
+			return false
+		}
+	} else {
+		k.inFlight.Add(1)
+	}
+
+	if k.rateLimiter != nil && !k.rateLimiter.Allow() {
+		k.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (k *APIKey) Release() {
+	k.inFlight.Add(-1)
+}
+
+// APIKeyStore holds the API keys. They are persisted in Redis, like the nodes.
+type APIKeyStore struct {
+	log        *zap.SugaredLogger
+	redisState *RedisState
+
+	lock sync.RWMutex
+	keys map[string]*APIKey
+}
+
+func NewAPIKeyStore(log *zap.SugaredLogger, redisState *RedisState) *APIKeyStore {
+	return &APIKeyStore{
+		log:        log,
+		redisState: redisState,
+		keys:       make(map[string]*APIKey),
+	}
+}
+
+func (s *APIKeyStore) LoadFromRedis() error {
+	if s.redisState == nil {
+		return nil
+	}
+	configs, err := s.redisState.GetAPIKeys()
+	if err != nil {
+		return errors.Wrap(err, "loading API keys from redis failed")
+	}
+	s.log.Infow("APIKeyStore: loaded API keys from redis", "numKeys", len(configs))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, config := range configs {
+		s.keys[config.Key] = newAPIKey(config)
+	}
+	return nil
+}
+
+// Get returns the API key, or nil if it doesn't exist
+func (s *APIKeyStore) Get(key string) *APIKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys[key]
+}
+
+// Configs returns the configs of all API keys, ordered by client
+func (s *APIKeyStore) Configs() []APIKeyConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	configs := make([]APIKeyConfig, 0, len(s.keys))
+	for _, key := range s.keys {
+		configs = append(configs, key.APIKeyConfig)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Client < configs[j].Client })
+	return configs
+}
+
+// AddKey adds or updates an API key, and saves the keys to Redis
+func (s *APIKeyStore) AddKey(config APIKeyConfig) error {
+	if config.Key == "" || config.Client == "" {
+		return errors.New("key and client are required")
+	} else if config.RateLimit < 0 || config.MaxConcurrent < 0 {
+		return errors.New("rateLimit and maxConcurrent must not be negative")
+	}
+
+	s.lock.Lock()
+	s.keys[config.Key] = newAPIKey(config)
+	s.lock.Unlock()
+	s.log.Infow("APIKeyStore: added API key", "client", config.Client)
+	return s.saveToRedis()
+}
+
+// DelKey removes an API key, and saves the keys to Redis. Returns false if the key didn't exist.
+func (s *APIKeyStore) DelKey(key string) (deleted bool, err error) {
+	s.lock.Lock()
+	apiKey, found := s.keys[key]
+	delete(s.keys, key)
+	s.lock.Unlock()
+	if !found {
+		return false, nil
+	}
+	s.log.Infow("APIKeyStore: removed API key", "client", apiKey.Client)
+	return true, s.saveToRedis()
+}
+
+func (s *APIKeyStore) saveToRedis() error {
+	if s.redisState == nil {
+		return nil
+	}
+	return s.redisState.SaveAPIKeys(s.Configs())
+}
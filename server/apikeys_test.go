@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyQuotas(t *testing.T) {
+	key := newAPIKey(APIKeyConfig{Key: "foo", Client: "builder", Queues: []string{QueueNameHighPrio}, MaxConcurrent: 2})
+	require.True(t, key.AllowsQueue(QueueNameHighPrio))
+	require.False(t, key.AllowsQueue(QueueNameFastTrack))
+
+	// Concurrency quota
+	require.True(t, key.Acquire())
+	require.True(t, key.Acquire())
+	require.False(t, key.Acquire())
+	key.Release()
+	require.True(t, key.Acquire())
+
+	// Rate quota (bursts of one second)
+	key = newAPIKey(APIKeyConfig{Key: "foo", Client: "builder", RateLimit: 2})
+	require.True(t, key.Acquire())
+	require.True(t, key.Acquire())
+	require.False(t, key.Acquire())
+	require.Equal(t, int32(2), key.inFlight.Load())
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	resetTestRedis()
+	store := NewAPIKeyStore(testLog, redisTestState)
+	require.NotNil(t, store.AddKey(APIKeyConfig{Key: "foo"}))
+	require.Nil(t, store.AddKey(APIKeyConfig{Key: "foo", Client: "builder", RateLimit: 10}))
+	require.Nil(t, store.AddKey(APIKeyConfig{Key: "bar", Client: "searcher"}))
+	require.Equal(t, "builder", store.Get("foo").Client)
+	require.Nil(t, store.Get("baz"))
+
+	// Keys are persisted in Redis
+	store2 := NewAPIKeyStore(testLog, redisTestState)
+	require.Nil(t, store2.LoadFromRedis())
+	require.Equal(t, store.Configs(), store2.Configs())
+
+	deleted, err := store.DelKey("foo")
+	require.Nil(t, err, err)
+	require.True(t, deleted)
+	deleted, err = store.DelKey("foo")
+	require.Nil(t, err, err)
+	require.False(t, deleted)
+	configs, err := redisTestState.GetAPIKeys()
+	require.Nil(t, err, err)
+	require.Equal(t, []APIKeyConfig{{Key: "bar", Client: "searcher"}}, configs)
+}
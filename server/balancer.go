@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// Balancer strategies, selectable with the BALANCER env var
+const (
+	BalancerLeastInFlight      = "least-in-flight"
+	BalancerP2CEWMA            = "p2c-ewma"
+	BalancerWeightedRoundRobin = "weighted-round-robin"
+	BalancerConsistentHash     = "consistent-hash"
+)
+
+// Balancer selects the node which processes a request
+type Balancer interface {
+	// Select returns one of the candidates (which all have free capacity). candidates is never empty.
+	Select(candidates []*Node, req *SimRequest) *Node
+}
+
+// nodeStateBalancer is implemented by balancers which keep state per node, to drop it when the node is removed
+type nodeStateBalancer interface {
+	RemoveNode(uri string)
+}
+
+// NewBalancer returns the balancer for the given strategy name
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case BalancerLeastInFlight:
+		return &LeastInFlightBalancer{}, nil
+	case BalancerP2CEWMA:
+		return &P2CEWMABalancer{}, nil
+	case BalancerWeightedRoundRobin:
+		return NewWeightedRoundRobinBalancer(), nil
+	case BalancerConsistentHash:
+		return &ConsistentHashBalancer{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer strategy: %s", strategy)
+}
+
+// LeastInFlightBalancer selects the node with the lowest number of in-flight requests relative to its capacity
+type LeastInFlightBalancer struct{}
+
+func (b *LeastInFlightBalancer) Select(candidates []*Node, req *SimRequest) *Node {
+	best := candidates[0]
+	bestLoad := best.load()
+	for _, node := range candidates[1:] {
+		if load := node.load(); load < bestLoad {
+			best, bestLoad = node, load
+		}
+	}
+	return best
+}
+
+// P2CEWMABalancer picks two random nodes and selects the one with the lower expected latency
+// (EWMA latency, weighted by the number of in-flight requests)
+type P2CEWMABalancer struct{}
+
+func (b *P2CEWMABalancer) Select(candidates []*Node, req *SimRequest) *Node {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	idx1 := rand.Intn(len(candidates))
+	idx2 := rand.Intn(len(candidates) - 1)
+	if idx2 >= idx1 {
+		idx2 += 1
+	}
+
+	node1, node2 := candidates[idx1], candidates[idx2]
+	if node2.expectedLatency() < node1.expectedLatency() {
+		return node2
+	}
+	return node1
+}
+
+// WeightedRoundRobinBalancer implements smooth weighted round robin (as used by nginx), spreading
+// requests evenly across nodes in proportion to their weight
+type WeightedRoundRobinBalancer struct {
+	lock           sync.Mutex
+	currentWeights map[string]int
+}
+
+func NewWeightedRoundRobinBalancer() *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{
+		currentWeights: make(map[string]int),
+	}
+}
+
+func (b *WeightedRoundRobinBalancer) Select(candidates []*Node, req *SimRequest) *Node {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var best *Node
+	totalWeight := 0
+	for _, node := range candidates {
+		weight := node.Weight()
+		totalWeight += weight
+		b.currentWeights[node.URI] += weight
+		if best == nil || b.currentWeights[node.URI] > b.currentWeights[best.URI] {
+			best = node
+		}
+	}
+	b.currentWeights[best.URI] -= totalWeight
+	return best
+}
+
+// RemoveNode drops the current weight of a removed node, so that it starts over if it's added again
+func (b *WeightedRoundRobinBalancer) RemoveNode(uri string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.currentWeights, uri)
+}
+
+// ConsistentHashBalancer sends requests with the same routing key to the same node, as long as it
+// is a candidate (rendezvous hashing). The routing key defaults to the payload.
+type ConsistentHashBalancer struct{}
+
+func (b *ConsistentHashBalancer) Select(candidates []*Node, req *SimRequest) *Node {
+	key := []byte(req.RoutingKey)
+	if len(key) == 0 {
+		key = req.Payload
+	}
+
+	var best *Node
+	var bestScore uint64
+	for _, node := range candidates {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write([]byte(node.URI))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
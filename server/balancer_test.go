@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestNodes(numWorkers ...int32) []*Node {
+	nodes := []*Node{}
+	for i, n := range numWorkers {
+		nodes = append(nodes, &Node{URI: fmt.Sprintf("http://node%d", i+1), numWorkers: n})
+	}
+	return nodes
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, strategy := range []string{BalancerLeastInFlight, BalancerP2CEWMA, BalancerWeightedRoundRobin, BalancerConsistentHash} {
+		b, err := NewBalancer(strategy)
+		require.Nil(t, err, err)
+		require.NotNil(t, b)
+	}
+
+	_, err := NewBalancer("foo")
+	require.NotNil(t, err)
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	nodes := newTestNodes(4, 4, 8)
+	nodes[0].inFlight.Store(2)
+	nodes[1].inFlight.Store(1)
+	nodes[2].inFlight.Store(3)
+
+	b := &LeastInFlightBalancer{}
+	req := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	require.Equal(t, nodes[1], b.Select(nodes, req))
+
+	nodes[1].inFlight.Store(3)
+	require.Equal(t, nodes[2], b.Select(nodes, req)) // 3/8 < 2/4 < 3/4
+}
+
+func TestP2CEWMABalancer(t *testing.T) {
+	nodes := newTestNodes(4, 4)
+	nodes[0].recordLatency(100 * time.Millisecond)
+	nodes[1].recordLatency(10 * time.Millisecond)
+
+	b := &P2CEWMABalancer{}
+	req := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, nodes[1], b.Select(nodes, req))
+	}
+
+	// many in-flight requests make the fast node less attractive
+	nodes[1].inFlight.Store(20)
+	require.Equal(t, nodes[0], b.Select(nodes, req))
+	require.Equal(t, nodes[0], b.Select(nodes[:1], req))
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	nodes := newTestNodes(1, 2, 3)
+	b := NewWeightedRoundRobinBalancer()
+	req := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+
+	counts := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		counts[b.Select(nodes, req).URI]++
+	}
+	require.Equal(t, 10, counts[nodes[0].URI])
+	require.Equal(t, 20, counts[nodes[1].URI])
+	require.Equal(t, 30, counts[nodes[2].URI])
+
+	// Removed nodes don't keep their current weight
+	b.RemoveNode(nodes[2].URI)
+	require.Equal(t, 2, len(b.currentWeights))
+}
+
+func TestWeightedRoundRobinBalancerNodeRemoved(t *testing.T) {
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	b := NewWeightedRoundRobinBalancer()
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	gp.SetBalancer(b)
+
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	require.Nil(t, gp.Dispatch(request, time.Second))
+	<-request.ResponseC
+	require.Equal(t, 1, len(b.currentWeights))
+
+	_, err := gp.DelNode(mockNodeServer.URL)
+	require.Nil(t, err, err)
+	require.Equal(t, 0, len(b.currentWeights))
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	nodes := newTestNodes(1, 1, 1, 1)
+	b := &ConsistentHashBalancer{}
+
+	req := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	req.RoutingKey = "client-1"
+	selected := b.Select(nodes, req)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, selected, b.Select(nodes, req))
+	}
+
+	// removing another node doesn't change the selection
+	others := []*Node{selected}
+	for _, node := range nodes {
+		if node != selected && len(others) < 3 {
+			others = append(others, node)
+		}
+	}
+	require.Equal(t, selected, b.Select(others, req))
+
+	// different keys are spread across nodes
+	selectedNodes := make(map[*Node]bool)
+	for i := 0; i < 100; i++ {
+		req.RoutingKey = fmt.Sprintf("client-%d", i)
+		selectedNodes[b.Select(nodes, req)] = true
+	}
+	require.Equal(t, len(nodes), len(selectedNodes))
+}
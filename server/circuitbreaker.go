@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // requests are processed normally
+	CircuitOpen     = "open"      // no requests are processed until the backoff period is over
+	CircuitHalfOpen = "half-open" // a single trial request decides whether to close or re-open the circuit
+)
+
+// CircuitBreaker tracks the results of the last requests to a node. If failureThreshold of the last
+// windowSize requests failed, the circuit opens for the backoff duration. After that, a single trial
+// request is allowed (half-open): on success the circuit closes, on failure it opens again.
+type CircuitBreaker struct {
+	lock sync.Mutex
+
+	failureThreshold int // 0 disables the circuit breaker
+	windowSize       int
+	backoff          time.Duration
+
+	state       string
+	openedAt    time.Time
+	trialActive bool   // in half-open state, whether the trial request was already handed out
+	results     []bool // ring buffer of the last windowSize results (true means failure)
+	resultsIdx  int
+}
+
+func NewCircuitBreaker(failureThreshold, windowSize int, backoff time.Duration) *CircuitBreaker {
+	if windowSize < failureThreshold {
+		windowSize = failureThreshold
+	}
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		windowSize:       windowSize,
+		backoff:          backoff,
+		state:            CircuitClosed,
+	}
+}
+
+// State returns the current state, switching from open to half-open if the backoff period is over
+func (cb *CircuitBreaker) State() string {
+	if cb == nil {
+		return CircuitClosed
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb._state()
+}
+
+func (cb *CircuitBreaker) _state() string {
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.backoff {
+		cb.state = CircuitHalfOpen
+		cb.trialActive = false
+	}
+	return cb.state
+}
+
+// Allow returns whether a request may be processed. In half-open state only one trial request is
+// allowed, isTrial is then true and the caller must either record the result or call CancelTrial.
+func (cb *CircuitBreaker) Allow() (allowed, isTrial bool) {
+	if cb == nil {
+		return true, false
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb._state() {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		if cb.trialActive {
+			return false, false
+		}
+		cb.trialActive = true
+		return true, true
+	}
+	return true, false
+}
+
+// CancelTrial gives back a trial request that was allowed but not used
+func (cb *CircuitBreaker) CancelTrial() {
+	if cb == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.trialActive = false
+}
+
+// RecordResult records the result of a request, and returns the new state if it changed
+func (cb *CircuitBreaker) RecordResult(failed bool) (newState string, changed bool) {
+	if cb == nil || cb.failureThreshold <= 0 {
+		return CircuitClosed, false
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	prevState := cb._state()
+	switch prevState {
+	case CircuitHalfOpen:
+		cb.trialActive = false
+		if failed {
+			cb.open()
+		} else {
+			cb.state = CircuitClosed
+			cb.results = nil
+			cb.resultsIdx = 0
+		}
+
+	case CircuitClosed:
+		if len(cb.results) < cb.windowSize {
+			cb.results = append(cb.results, failed)
+		} else {
+			cb.results[cb.resultsIdx] = failed
+			cb.resultsIdx = (cb.resultsIdx + 1) % cb.windowSize
+		}
+
+		numFailures := 0
+		for _, f := range cb.results {
+			if f {
+				numFailures += 1
+			}
+		}
+		if numFailures >= cb.failureThreshold {
+			cb.open()
+		}
+	}
+
+	return cb.state, cb.state != prevState
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.state = CircuitOpen
+	cb.openedAt = time.Now()
+	cb.results = nil
+	cb.resultsIdx = 0
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(3, 5, 50*time.Millisecond)
+	require.Equal(t, CircuitClosed, cb.State())
+
+	// 2 of 5 failures keep the circuit closed
+	for _, failed := range []bool{true, false, false, false, true} {
+		_, changed := cb.RecordResult(failed)
+		require.False(t, changed)
+	}
+
+	// the oldest failure drops out of the window
+	cb.RecordResult(false)
+	cb.RecordResult(true)
+	require.Equal(t, CircuitClosed, cb.State())
+
+	// 3 of the last 5 failed -> open
+	state, changed := cb.RecordResult(true)
+	require.True(t, changed)
+	require.Equal(t, CircuitOpen, state)
+	allowed, _ := cb.Allow()
+	require.False(t, allowed)
+
+	// results of requests that were in flight while opening are ignored
+	_, changed = cb.RecordResult(false)
+	require.False(t, changed)
+
+	// after the backoff, a single trial request is allowed
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, CircuitHalfOpen, cb.State())
+	allowed, isTrial := cb.Allow()
+	require.True(t, allowed)
+	require.True(t, isTrial)
+	allowed, _ = cb.Allow()
+	require.False(t, allowed)
+
+	// a cancelled trial can be taken again
+	cb.CancelTrial()
+	allowed, isTrial = cb.Allow()
+	require.True(t, allowed)
+	require.True(t, isTrial)
+
+	// a failed trial re-opens the circuit
+	state, _ = cb.RecordResult(true)
+	require.Equal(t, CircuitOpen, state)
+
+	// a successful trial closes it
+	time.Sleep(60 * time.Millisecond)
+	allowed, _ = cb.Allow()
+	require.True(t, allowed)
+	state, changed = cb.RecordResult(false)
+	require.True(t, changed)
+	require.Equal(t, CircuitClosed, state)
+	allowed, isTrial = cb.Allow()
+	require.True(t, allowed)
+	require.False(t, isTrial)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cb := NewCircuitBreaker(0, 10, time.Second)
+	for i := 0; i < 20; i++ {
+		cb.RecordResult(true)
+	}
+	require.Equal(t, CircuitClosed, cb.State())
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PriorityRule assigns a priority class to the requests it matches. All given match conditions
+// (methods, API keys, path prefix, headers) must be met for a rule to match.
+type PriorityRule struct {
+	Name       string            `json:"name,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`    // JSON-RPC methods, empty matches any method
+	APIKeys    []string          `json:"apiKeys,omitempty"`    // API keys (X-API-Key header or bearer token), empty matches any
+	PathPrefix string            `json:"pathPrefix,omitempty"` // request path prefix, i.e. `/sim/fast`
+	Headers    map[string]string `json:"headers,omitempty"`    // request headers which need to have the given value
+
+	Queue string `json:"queue"` // queue class, i.e. fast-track, high-prio or low-prio (see QueueClass)
+}
+
+// PriorityRules is an ordered list of rules, the first matching rule applies. If no rule matches, the
+// priority is taken from the X-Fast-Track and X-High-Priority headers.
+type PriorityRules []PriorityRule
+
+// LoadPriorityRules reads the priority rules from a JSON file. Rules must use one of the given queue classes.
+func LoadPriorityRules(filename string, queueClasses []string) (PriorityRules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading priority rules failed")
+	}
+
+	rules := PriorityRules{}
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "parsing priority rules failed")
+	}
+
+	for i, rule := range rules {
+		if !containsString(queueClasses, rule.Queue) {
+			return nil, errors.Errorf("priority rule %d (%s) has an invalid queue: %s", i, rule.Name, rule.Queue)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *PriorityRule) matches(method, path string, header http.Header) bool {
+	if len(rule.Methods) > 0 && !containsString(rule.Methods, method) {
+		return false
+	}
+	if len(rule.APIKeys) > 0 && !containsString(rule.APIKeys, requestAPIKey(header)) {
+		return false
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(path, rule.PathPrefix) {
+		return false
+	}
+	for key, value := range rule.Headers {
+		if header.Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Classify returns the first rule matching the request, or nil if no rule matches
+func (rules PriorityRules) Classify(method, path string, header http.Header) *PriorityRule {
+	for i := range rules {
+		if rules[i].matches(method, path, header) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// requestAPIKey returns the API key of a request, from the X-API-Key header or a bearer token
+func requestAPIKey(header http.Header) string {
+	if apiKey := header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+	if token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
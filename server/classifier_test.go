@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityRulesClassify(t *testing.T) {
+	rules := PriorityRules{
+		{Name: "path", PathPrefix: "/sim/fast", Queue: QueueNameFastTrack},
+		{Name: "builder", APIKeys: []string{"builder-key"}, Methods: []string{"eth_callBundle"}, Queue: QueueNameHighPrio},
+		{Name: "header", Headers: map[string]string{"X-Source": "backfill"}, Queue: QueueNameLowPrio},
+	}
+
+	require.Equal(t, "path", rules.Classify("eth_call", "/sim/fast", http.Header{}).Name)
+	require.Nil(t, rules.Classify("eth_callBundle", "/sim", http.Header{}))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer builder-key")
+	require.Equal(t, "builder", rules.Classify("eth_callBundle", "/", header).Name)
+	require.Nil(t, rules.Classify("eth_call", "/", header))
+
+	header = http.Header{}
+	header.Set("X-Source", "backfill")
+	require.Equal(t, "header", rules.Classify("eth_callBundle", "/", header).Name)
+}
+
+func TestRequestAPIKey(t *testing.T) {
+	header := http.Header{}
+	require.Equal(t, "", requestAPIKey(header))
+	header.Set("Authorization", "Bearer foo")
+	require.Equal(t, "foo", requestAPIKey(header))
+	header.Set("X-API-Key", "bar")
+	require.Equal(t, "bar", requestAPIKey(header))
+}
+
+func TestLoadPriorityRules(t *testing.T) {
+	queueClasses := []string{QueueNameFastTrack, QueueNameHighPrio, QueueNameLowPrio}
+	fn := filepath.Join(t.TempDir(), "rules.json")
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"fast","pathPrefix":"/sim/fast","queue":"fast-track"}]`), 0o600))
+	rules, err := LoadPriorityRules(fn, queueClasses)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(rules))
+
+	// Unknown queue
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"fast","pathPrefix":"/sim/fast","queue":"foo"}]`), 0o600))
+	_, err = LoadPriorityRules(fn, queueClasses)
+	require.NotNil(t, err)
+}
+
+func TestWebserverPriorityRules(t *testing.T) {
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), NewNodePool(testLog, nil, 1))
+	webserver.priorityRules = PriorityRules{
+		{PathPrefix: "/sim/fast", Queue: QueueNameFastTrack},
+		{Methods: []string{"eth_call"}, Queue: QueueNameLowPrio},
+	}
+	requestQueue := func(req *http.Request, payload []byte) string {
+		simReq, _ := webserver.newSimRequest(req, "1", payload, testLog)
+		return queueName(simReq)
+	}
+
+	// Rules override the priority headers
+	payload := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	req := httptest.NewRequest(http.MethodPost, "/sim", bytes.NewReader(payload))
+	req.Header.Set("X-High-Priority", "true")
+	require.Equal(t, QueueNameLowPrio, requestQueue(req, payload))
+
+	req = httptest.NewRequest(http.MethodPost, "/sim/fast", bytes.NewReader(payload))
+	require.Equal(t, QueueNameFastTrack, requestQueue(req, payload))
+
+	// Without matching rule, the headers decide
+	payload = []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`)
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	req.Header.Set("X-High-Priority", "true")
+	require.Equal(t, QueueNameHighPrio, requestQueue(req, payload))
+}
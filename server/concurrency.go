@@ -0,0 +1,149 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	concurrencyDecreaseFactor    = 0.9 // multiplicative decrease of the limit on failures and latency spikes
+	concurrencyWindowSize        = 20  // number of requests which are evaluated together, with at most one decrease per window
+	concurrencyLatencyPercentile = 0.5 // latency percentile of a window which is compared to the baseline (robust to single slow requests)
+	concurrencyMinLatencyWindows = 25  // the baseline latency is reset after this many windows, to adapt to changing workloads
+)
+
+// ConcurrencyLimiter adapts the number of concurrent requests to a node with AIMD, evaluated per window of
+// concurrencyWindowSize requests: the limit grows by one for every limit successful requests, and shrinks once
+// by concurrencyDecreaseFactor on a failure, or if the window's median latency exceeds the baseline (lowest
+// window minimum) by more than the tolerance.
+type ConcurrencyLimiter struct {
+	lock sync.Mutex
+
+	minLimit         float64
+	maxLimit         float64
+	latencyTolerance float64 // latency/baseline ratio above which the node is considered overloaded
+
+	limit      float64
+	minLatency time.Duration // baseline latency of the node
+	numWindows int           // number of windows since the baseline was reset
+
+	latencies  []time.Duration // latencies of the successful requests in the current window
+	numSamples int             // number of requests in the current window
+	decreased  bool            // whether the limit was decreased in the current window
+}
+
+// NewConcurrencyLimiter returns a limiter starting at maxLimit
+func NewConcurrencyLimiter(minLimit, maxLimit int, latencyTolerance float64) *ConcurrencyLimiter {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	l := &ConcurrencyLimiter{
+		minLimit:         float64(minLimit),
+		latencyTolerance: latencyTolerance,
+	}
+	l.SetMaxLimit(maxLimit)
+	l.limit = l.maxLimit
+	return l
+}
+
+// newNodeConcurrencyLimiter returns the limiter for a new node, or nil if adaptive concurrency is disabled
+func newNodeConcurrencyLimiter(numWorkers int32) *ConcurrencyLimiter {
+	if !AdaptiveConcurrency {
+		return nil
+	}
+	return NewConcurrencyLimiter(AdaptiveConcurrencyMin, maxConcurrencyLimit(numWorkers), float64(AdaptiveConcurrencyLatencyTolerancePct)/100)
+}
+
+// maxConcurrencyLimit returns the upper bound of the concurrency limit for a node with numWorkers workers
+func maxConcurrencyLimit(numWorkers int32) int {
+	if AdaptiveConcurrencyMax > 0 && AdaptiveConcurrencyMax < int(numWorkers) {
+		return AdaptiveConcurrencyMax
+	}
+	return int(numWorkers)
+}
+
+// SetMaxLimit changes the upper bound, i.e. when the number of workers of the node changes
+func (l *ConcurrencyLimiter) SetMaxLimit(maxLimit int) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maxLimit = math.Max(l.minLimit, float64(maxLimit))
+	l.limit = l.bound(l.limit)
+}
+
+func (l *ConcurrencyLimiter) bound(limit float64) float64 {
+	return math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+}
+
+// Limit returns the current concurrency limit, or -1 if there is no limiter
+func (l *ConcurrencyLimiter) Limit() int32 {
+	if l == nil {
+		return -1
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int32(l.limit)
+}
+
+// RecordResult updates the limit with the result of a request, and returns the new limit if it changed
+func (l *ConcurrencyLimiter) RecordResult(latency time.Duration, failed bool) (newLimit int32, changed bool) {
+	if l == nil {
+		return -1, false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	prevLimit := int32(l.limit)
+	if failed {
+		l.decrease()
+	} else {
+		l.latencies = append(l.latencies, latency)
+	}
+
+	l.numSamples += 1
+	if l.numSamples >= concurrencyWindowSize {
+		l.evaluateWindow()
+	}
+	return int32(l.limit), int32(l.limit) != prevLimit
+}
+
+// decrease lowers the limit, once per window. Requires the lock.
+func (l *ConcurrencyLimiter) decrease() {
+	if l.decreased {
+		return
+	}
+	l.limit = l.bound(l.limit * concurrencyDecreaseFactor)
+	l.decreased = true
+}
+
+// evaluateWindow compares the latency of the window to the baseline, and starts a new window. Requires the lock.
+func (l *ConcurrencyLimiter) evaluateWindow() {
+	if len(l.latencies) > 0 {
+		sort.Slice(l.latencies, func(i, j int) bool { return l.latencies[i] < l.latencies[j] })
+		windowMin := l.latencies[0]
+		windowLatency := l.latencies[int(float64(len(l.latencies)-1)*concurrencyLatencyPercentile)]
+
+		l.numWindows += 1
+		if l.minLatency == 0 || windowMin < l.minLatency || l.numWindows > concurrencyMinLatencyWindows {
+			l.minLatency = windowMin
+			l.numWindows = 0
+		}
+
+		if float64(windowLatency) > float64(l.minLatency)*l.latencyTolerance {
+			l.decrease()
+		} else if !l.decreased {
+			l.limit = l.bound(l.limit + float64(len(l.latencies))/l.limit)
+		}
+	}
+
+	l.latencies = l.latencies[:0]
+	l.numSamples = 0
+	l.decreased = false
+}
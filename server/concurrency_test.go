@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := NewConcurrencyLimiter(2, 10, 2)
+	require.Equal(t, int32(10), l.Limit())
+
+	// A failure decreases the limit multiplicatively, but only once per window
+	newLimit, changed := l.RecordResult(0, true)
+	require.True(t, changed)
+	require.Equal(t, int32(9), newLimit)
+	for i := 1; i < concurrencyWindowSize; i++ {
+		l.RecordResult(0, true)
+	}
+	require.Equal(t, int32(9), l.Limit())
+	for i := 0; i < 50*concurrencyWindowSize; i++ {
+		l.RecordResult(0, true)
+	}
+	require.Equal(t, int32(2), l.Limit())
+
+	// Successful requests increase the limit additively, up to the max limit
+	recordWindow := func(latencies ...time.Duration) {
+		for i := 0; i < concurrencyWindowSize; i++ {
+			l.RecordResult(latencies[i%len(latencies)], false)
+		}
+	}
+	recordWindow(10 * time.Millisecond)
+	require.Equal(t, int32(10), l.Limit())
+
+	// Single slow requests don't decrease the limit, only a slow window median does
+	recordWindow(10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond, time.Second)
+	require.Equal(t, int32(10), l.Limit())
+	recordWindow(15 * time.Millisecond)
+	require.Equal(t, int32(10), l.Limit())
+	recordWindow(10*time.Millisecond, 25*time.Millisecond, 25*time.Millisecond)
+	require.Equal(t, int32(9), l.Limit())
+
+	// The slow window didn't move the baseline
+	recordWindow(25 * time.Millisecond)
+	require.Equal(t, int32(8), l.Limit())
+
+	// Lowering the max limit (i.e. fewer workers) caps the limit
+	l.SetMaxLimit(4)
+	require.Equal(t, int32(4), l.Limit())
+}
+
+func TestConcurrencyLimiterDisabled(t *testing.T) {
+	var l *ConcurrencyLimiter
+	require.Equal(t, int32(-1), l.Limit())
+	_, changed := l.RecordResult(time.Second, true)
+	require.False(t, changed)
+
+	node := &Node{numWorkers: 3}
+	require.Equal(t, int32(3), node.capacity())
+	node.concurrencyLimiter = NewConcurrencyLimiter(1, 3, 2)
+	node.concurrencyLimiter.RecordResult(0, true)
+	require.Equal(t, int32(2), node.capacity())
+}
@@ -8,9 +8,18 @@ import (
 )
 
 var (
-	JobChannelBuffer = GetEnvInt("JOB_CHAN_BUFFER", 2)          // buffer for JobC in backends (for transporting jobs from server -> backend node)
-	RequestMaxTries  = GetEnvInt("RETRIES_MAX", 3)              // 3 tries means it will be retried 2 additional times, and on third error would fail
-	PayloadMaxBytes  = GetEnvInt("PAYLOAD_MAX_KB", 8192) * 1024 // Max payload size in bytes. If a payload sent to the webserver is larger, it returns "400 Bad Request".
+	RequestMaxTries = GetEnvInt("RETRIES_MAX", 3)              // 3 tries means it will be retried 2 additional times, and on third error would fail
+	PayloadMaxBytes = GetEnvInt("PAYLOAD_MAX_KB", 8192) * 1024 // Max payload size in bytes. If a payload sent to the webserver is larger, it returns "400 Bad Request".
+
+	MethodsAllow = GetEnv("METHODS_ALLOW", "")                          // Comma-separated JSON-RPC methods (or prefixes like `eth_*`) which may be sent to the nodes. Empty allows all methods.
+	MethodsDeny  = GetEnv("METHODS_DENY", "admin_*,debug_*,personal_*") // Comma-separated JSON-RPC methods (or prefixes) which are rejected with error -32601
+
+	JSONRPCErrors = os.Getenv("JSONRPC_ERRORS") == "1" // whether balancer failures (queue full, timeouts, no nodes) are returned as JSON-RPC errors with 429/503/504 (otherwise plain-text 500)
+
+	BatchRequests = os.Getenv("BATCH_REQUESTS") == "1" // whether JSON-RPC batch requests are split into separate requests per call (otherwise the batch is sent to a single node)
+	BatchMaxSize  = GetEnvInt("BATCH_MAX_SIZE", 100)   // Max number of calls in a JSON-RPC batch request
+
+	QueueClassesFile = GetEnv("QUEUE_CLASSES_FILE", "") // JSON file with the queue classes. If not set, the fast-track/high-prio/low-prio settings below are used.
 
 	MaxQueueItemsFastTrack = GetEnvInt("ITEMS_FASTTRACK_MAX", 0) // Max number of items in fast-track queue. 0 means no limit.
 	MaxQueueItemsHighPrio  = GetEnvInt("ITEMS_HIGHPRIO_MAX", 0)  // Max number of items in high-prio queue. 0 means no limit.
@@ -20,14 +29,58 @@ var (
 	FastTrackPerHighPrio = GetEnvInt("ITEMS_FASTTRACK_PER_HIGHPRIO", 2)
 	FastTrackDrainFirst  = os.Getenv("FASTTRACK_DRAIN_FIRST") == "1" // whether to fully drain the fast-track queue first
 
+	LowPrioAgingThresholdMs = GetEnvInt("LOWPRIO_AGING_THRESHOLD_MS", 0) // Low-prio requests waiting longer than this are served before the other queues (at most every 4th request). 0 disables aging.
+
+	FairQueuing            = os.Getenv("FAIR_QUEUING") == "1"     // whether the clients take turns within each queue, instead of first come first served
+	MaxQueueItemsPerClient = GetEnvInt("ITEMS_PER_CLIENT_MAX", 0) // Max number of items of a client in each queue (with fair queuing). 0 means no limit.
+	ClientIDHeader         = GetEnv("CLIENT_ID_HEADER", "")       // Header set by a trusted proxy which identifies the client, i.e. `X-Client-ID`. Empty means the source IP is used (if there's no API key).
+	TrustedProxies         = GetEnv("TRUSTED_PROXIES", "")        // Comma-separated IPs or CIDRs of the proxies whose ClientIDHeader is used, required with CLIENT_ID_HEADER
+
+	APIKeysRequired = os.Getenv("API_KEYS_REQUIRED") == "1" // whether requests need an API key (X-API-Key header or bearer token), managed through /apikeys
+	RateLimits      = GetEnv("RATE_LIMITS", "")             // Requests per second per client and queue, i.e. `fast-track:10,high-prio:50` (shared by all instances with Redis). Empty means no limit.
+
+	AdmissionTarget   = time.Duration(GetEnvInt("ADMISSION_TARGET_MS", 0)) * time.Millisecond      // Queue delay above which low-prio requests are shed (503 with Retry-After). 0 disables admission control.
+	AdmissionInterval = time.Duration(GetEnvInt("ADMISSION_INTERVAL_MS", 1000)) * time.Millisecond // Interval in which the queue delay needs to drop below the target at least once
+
 	RequestTimeout       = time.Duration(GetEnvInt("REQUEST_TIMEOUT", 5)) * time.Second       // Time between creation and receive in the node worker, after which a SimRequest will not be processed anymore
-	ServerJobSendTimeout = time.Duration(GetEnvInt("JOB_SEND_TIMEOUT", 2)) * time.Second      // How long the server tries to send a job into the nodepool for processing
+	ServerJobSendTimeout = time.Duration(GetEnvInt("JOB_SEND_TIMEOUT", 2)) * time.Second      // How long the server waits for a node to take a job for processing
 	ProxyRequestTimeout  = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT", 3)) * time.Second // HTTP request timeout for proxy requests to the backend node
 
+	NodeBalancer      = GetEnv("BALANCER", BalancerLeastInFlight)                        // Node selection strategy: least-in-flight, p2c-ewma, weighted-round-robin or consistent-hash
+	PriorityRulesFile = GetEnv("PRIORITY_RULES_FILE", "")                                // JSON file with rules which assign the priority class by method, API key, path prefix or header
+	RoutingRulesFile  = GetEnv("ROUTING_RULES_FILE", "")                                 // JSON file with rules which restrict requests to nodes with certain labels
+	NodeDrainTimeout  = time.Duration(GetEnvInt("NODE_DRAIN_TIMEOUT", 60)) * time.Second // Default for how long a draining node may finish its requests in flight
+
+	HealthCheckInterval           = time.Duration(GetEnvInt("HEALTHCHECK_INTERVAL", 10)) * time.Second // How often each node is health-checked. 0 disables periodic health checks.
+	HealthCheckTimeout            = time.Duration(GetEnvInt("HEALTHCHECK_TIMEOUT", 5)) * time.Second   // HTTP request timeout for a single health check
+	HealthCheckMethod             = GetEnv("HEALTHCHECK_METHOD", "net_version")                        // JSON-RPC method used for health checks
+	HealthCheckUnhealthyThreshold = GetEnvInt("HEALTHCHECK_UNHEALTHY_THRESHOLD", 3)                    // Consecutive failed health checks after which a node is marked unhealthy
+	HealthCheckHealthyThreshold   = GetEnvInt("HEALTHCHECK_HEALTHY_THRESHOLD", 2)                      // Consecutive successful health checks after which an unhealthy node is re-admitted
+
+	HeadCheckInterval = time.Duration(GetEnvInt("HEAD_CHECK_INTERVAL", 1)) * time.Second           // How often the head (eth_blockNumber, eth_syncing) of each node is checked. 0 disables head tracking.
+	MaxBlockLag       = GetEnvInt("MAX_BLOCK_LAG", 2)                                              // Nodes more than this many blocks behind the best head in the pool don't take jobs
+	BlockWaitTimeout  = time.Duration(GetEnvInt("BLOCK_WAIT_TIMEOUT_MS", 1000)) * time.Millisecond // How long a request for a block that no node has yet is held in the queue
+
+	CircuitBreakerFailures = GetEnvInt("CIRCUIT_BREAKER_FAILURES", 5)                              // Open the circuit of a node if this many of the last CircuitBreakerWindow requests failed. 0 disables the circuit breaker.
+	CircuitBreakerWindow   = GetEnvInt("CIRCUIT_BREAKER_WINDOW", 10)                               // Number of most recent requests to a node considered by the circuit breaker
+	CircuitBreakerBackoff  = time.Duration(GetEnvInt("CIRCUIT_BREAKER_BACKOFF", 10)) * time.Second // How long an open circuit stops a node from taking jobs before a trial request is allowed
+
+	AdaptiveConcurrency                    = os.Getenv("ADAPTIVE_CONCURRENCY") == "1"                     // whether the number of concurrent requests per node adapts to its latency and errors (bounded by the number of workers)
+	AdaptiveConcurrencyMin                 = GetEnvInt("ADAPTIVE_CONCURRENCY_MIN", 1)                     // Lower bound for the adaptive concurrency limit of a node
+	AdaptiveConcurrencyMax                 = GetEnvInt("ADAPTIVE_CONCURRENCY_MAX", 0)                     // Upper bound for the adaptive concurrency limit of a node. 0 means the number of workers.
+	AdaptiveConcurrencyLatencyTolerancePct = GetEnvInt("ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE_PCT", 200) // The limit is decreased if the median latency of a window of requests exceeds this percentage of the lowest recent latency
+
 	RedisPrefix        = GetEnv("REDIS_PREFIX", "prio-load-balancer:") // All redis keys will be prefixed with this
+	NodeEventsMax      = GetEnvInt("NODE_EVENTS_MAX", 10000)           // Number of node pool changes kept in the audit trail in redis (approximately)
 	EnableErrorTestAPI = os.Getenv("ENABLE_ERROR_TEST_API") == "1"     // will enable /debug/testLogLevels which prints errors and ends with a panic (also enabled if mock-node is used)
 	EnablePprof        = os.Getenv("ENABLE_PPROF") == "1"              // will enable /debug/pprof
 
+	AdminListenAddr      = GetEnv("ADMIN_LISTEN_ADDR", "")       // Listen address for the admin API (/nodes, /apikeys, /metrics, debug APIs). If empty, it's served on the public listener.
+	AdminToken           = os.Getenv("ADMIN_TOKEN")              // Bearer token (or X-API-Key header) required for the admin API
+	AdminTLSCertFile     = os.Getenv("ADMIN_TLS_CERT_FILE")      // TLS certificate of the admin listener
+	AdminTLSKeyFile      = os.Getenv("ADMIN_TLS_KEY_FILE")       // TLS key of the admin listener
+	AdminTLSClientCAFile = os.Getenv("ADMIN_TLS_CLIENT_CA_FILE") // CA for admin client certificates (mTLS), accepted instead of the admin token
+
 	ProxyMaxIdleConns        = GetEnvInt("ProxyMaxIdleConns", 100)
 	ProxyMaxConnsPerHost     = GetEnvInt("ProxyMaxConnsPerHost", 100)
 	ProxyMaxIdleConnsPerHost = GetEnvInt("ProxyMaxIdleConnsPerHost", 100)
@@ -36,19 +89,56 @@ var (
 
 func LogConfig(log *zap.SugaredLogger) {
 	log.Infow("config",
-		"JobChannelBuffer", JobChannelBuffer,
 		"RequestMaxTries", RequestMaxTries,
+		"QueueClassesFile", QueueClassesFile,
 		"MaxQueueItemsHighPrio", MaxQueueItemsHighPrio,
 		"MaxQueueItemsLowPrio", MaxQueueItemsLowPrio,
 		"FastTrackPerHighPrio", FastTrackPerHighPrio,
 		"FastTrackDrainFirst", FastTrackDrainFirst,
+		"LowPrioAgingThresholdMs", LowPrioAgingThresholdMs,
+		"FairQueuing", FairQueuing,
+		"MaxQueueItemsPerClient", MaxQueueItemsPerClient,
+		"ClientIDHeader", ClientIDHeader,
+		"TrustedProxies", TrustedProxies,
+		"APIKeysRequired", APIKeysRequired,
+		"RateLimits", RateLimits,
+		"AdmissionTarget", AdmissionTarget,
+		"AdmissionInterval", AdmissionInterval,
 		"PayloadMaxBytes", PayloadMaxBytes,
+		"MethodsAllow", MethodsAllow,
+		"MethodsDeny", MethodsDeny,
+		"JSONRPCErrors", JSONRPCErrors,
+		"BatchRequests", BatchRequests,
+		"BatchMaxSize", BatchMaxSize,
 		"RequestTimeout", RequestTimeout,
 		"ServerJobSendTimeout", ServerJobSendTimeout,
 		"ProxyRequestTimeout", ProxyRequestTimeout,
+		"NodeBalancer", NodeBalancer,
+		"PriorityRulesFile", PriorityRulesFile,
+		"RoutingRulesFile", RoutingRulesFile,
+		"NodeDrainTimeout", NodeDrainTimeout,
+		"HealthCheckInterval", HealthCheckInterval,
+		"HealthCheckTimeout", HealthCheckTimeout,
+		"HealthCheckMethod", HealthCheckMethod,
+		"HealthCheckUnhealthyThreshold", HealthCheckUnhealthyThreshold,
+		"HealthCheckHealthyThreshold", HealthCheckHealthyThreshold,
+		"HeadCheckInterval", HeadCheckInterval,
+		"MaxBlockLag", MaxBlockLag,
+		"BlockWaitTimeout", BlockWaitTimeout,
+		"CircuitBreakerFailures", CircuitBreakerFailures,
+		"CircuitBreakerWindow", CircuitBreakerWindow,
+		"CircuitBreakerBackoff", CircuitBreakerBackoff,
+		"AdaptiveConcurrency", AdaptiveConcurrency,
+		"AdaptiveConcurrencyMin", AdaptiveConcurrencyMin,
+		"AdaptiveConcurrencyMax", AdaptiveConcurrencyMax,
+		"AdaptiveConcurrencyLatencyTolerancePct", AdaptiveConcurrencyLatencyTolerancePct,
 		"RedisPrefix", RedisPrefix,
 		"EnableErrorTestAPI", EnableErrorTestAPI,
 		"EnablePprof", EnablePprof,
+		"NodeEventsMax", NodeEventsMax,
+		"AdminListenAddr", AdminListenAddr,
+		"AdminAuth", adminAuthEnabled(),
+		"AdminTLS", AdminTLSCertFile != "",
 		"ProxyMaxIdleConns", ProxyMaxIdleConns,
 		"ProxyMaxConnsPerHost", ProxyMaxConnsPerHost,
 		"ProxyMaxIdleConnsPerHost", ProxyMaxIdleConnsPerHost,
@@ -1,9 +1,67 @@
 package server
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+)
 
 var (
-	ErrRequestTimeout   = errors.New("request timeout hit before processing")
-	ErrNodeTimeout      = errors.New("node timeout")
-	ErrNoNodesAvailable = errors.New("no nodes available")
+	ErrQueueFull         = errors.New("queue full")
+	ErrPayloadTooLarge   = errors.New("payload too large")
+	ErrRequestTimeout    = errors.New("request timeout hit before processing")
+	ErrNodeTimeout       = errors.New("node timeout")
+	ErrNoNodesAvailable  = errors.New("no nodes available")
+	ErrBlockNotAvailable = errors.New("no node has the requested block")
+	ErrNodeNotFound      = errors.New("node not found")
+	ErrInvalidNumWorkers = errors.New("number of workers must be at least 1")
+	ErrOverloaded        = errors.New("server overloaded, try again later")
+	ErrUnauthorized      = errors.New("missing or invalid API key")
+	ErrQueueNotAllowed   = errors.New("priority not allowed for this API key")
+	ErrQuotaExceeded     = errors.New("API key quota exceeded")
+	ErrRateLimited       = errors.New("rate limit exceeded")
+	ErrNoNodeEvents      = errors.New("node events are only recorded with redis")
+)
+
+// JSON-RPC error codes for balancer failures, used in responses if JSONRPC_ERRORS=1
+const (
+	JSONRPCErrQueueFull         = -32005 // the queue for the request priority is full
+	JSONRPCErrRequestTimeout    = -32006 // the request timed out in the queue before being processed
+	JSONRPCErrNodeTimeout       = -32007 // no node took the request in time
+	JSONRPCErrNoNodesAvailable  = -32008 // no available node may process the request
+	JSONRPCErrBlockNotAvailable = -32009 // no node has the block required by the request
+	JSONRPCErrOverloaded        = -32010 // the request was shed because the queue delay is above the target
+	JSONRPCErrUnauthorized      = -32011 // the API key is missing or invalid
+	JSONRPCErrQueueNotAllowed   = -32012 // the API key may not use the priority of the request
+	JSONRPCErrQuotaExceeded     = -32013 // the request rate or concurrency quota of the API key is exceeded
+	JSONRPCErrRateLimited       = -32014 // the client exceeded the rate limit of the queue class
 )
+
+// jsonRPCErrorCode returns the JSON-RPC error code and HTTP status code for a request that failed in the
+// balancer. Other errors (i.e. failed proxy requests) are internal errors with 502 Bad Gateway.
+func jsonRPCErrorCode(err error) (code, statusCode int) {
+	switch err {
+	case ErrQueueFull:
+		return JSONRPCErrQueueFull, http.StatusTooManyRequests
+	case ErrPayloadTooLarge:
+		return JSONRPCErrInvalidRequest, http.StatusRequestEntityTooLarge
+	case ErrRequestTimeout:
+		return JSONRPCErrRequestTimeout, http.StatusGatewayTimeout
+	case ErrNodeTimeout:
+		return JSONRPCErrNodeTimeout, http.StatusGatewayTimeout
+	case ErrNoNodesAvailable:
+		return JSONRPCErrNoNodesAvailable, http.StatusServiceUnavailable
+	case ErrBlockNotAvailable:
+		return JSONRPCErrBlockNotAvailable, http.StatusServiceUnavailable
+	case ErrOverloaded:
+		return JSONRPCErrOverloaded, http.StatusServiceUnavailable
+	case ErrUnauthorized:
+		return JSONRPCErrUnauthorized, http.StatusUnauthorized
+	case ErrQueueNotAllowed:
+		return JSONRPCErrQueueNotAllowed, http.StatusForbidden
+	case ErrQuotaExceeded:
+		return JSONRPCErrQuotaExceeded, http.StatusTooManyRequests
+	case ErrRateLimited:
+		return JSONRPCErrRateLimited, http.StatusTooManyRequests
+	}
+	return JSONRPCErrInternal, http.StatusBadGateway
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC error codes as per the spec
+const (
+	JSONRPCErrParse          = -32700
+	JSONRPCErrInvalidRequest = -32600
+	JSONRPCErrMethodNotFound = -32601
+	JSONRPCErrInternal       = -32603
+)
+
+type JSONRPCResponse struct {
+	ID      interface{}     `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	Version string          `json:"jsonrpc"`
+}
+
+// JSONRPCError as per the spec: https://www.jsonrpc.org/specification#error_object
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err JSONRPCError) Error() string {
+	return fmt.Sprintf("Error %d (%s)", err.Code, err.Message)
+}
+
+// ParseMethod returns the method of a JSON-RPC request, or an empty string if the payload can't be parsed
+func ParseMethod(payload []byte) string {
+	req := struct {
+		Method string `json:"method"`
+	}{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return ""
+	}
+	return req.Method
+}
+
+// ParseID returns the id of a JSON-RPC request (nil if missing or the payload can't be parsed)
+func ParseID(payload []byte) interface{} {
+	req := struct {
+		ID json.RawMessage `json:"id"`
+	}{}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.ID) == 0 {
+		return nil
+	}
+	return req.ID
+}
+
+// IsNotification returns true if the payload is a JSON-RPC request object without an id member, which per
+// the spec gets no response
+func IsNotification(payload []byte) bool {
+	req := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	_, hasID := req["id"]
+	return !hasID
+}
+
+// isBatchPayload returns true if the payload is a JSON array (JSON-RPC batch request)
+func isBatchPayload(payload []byte) bool {
+	payload = bytes.TrimLeft(payload, " \t\r\n")
+	return len(payload) > 0 && payload[0] == '['
+}
+
+// isJSONRPCResponse returns true if the payload is a JSON-RPC response object
+func isJSONRPCResponse(payload []byte) bool {
+	resp := JSONRPCResponse{}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return false
+	}
+	return resp.Result != nil || resp.Error != nil
+}
+
+// ParseRequiredBlockNumber returns the block a node needs to have imported to process an eth_callBundle
+// request: the stateBlockNumber if given as number, otherwise the parent of blockNumber. Returns 0 if
+// the request is not an eth_callBundle call or has no block requirement.
+func ParseRequiredBlockNumber(payload []byte) uint64 {
+	req := struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}{}
+	if err := json.Unmarshal(payload, &req); err != nil || req.Method != "eth_callBundle" || len(req.Params) == 0 {
+		return 0
+	}
+
+	bundleArgs := struct {
+		BlockNumber      string `json:"blockNumber"`
+		StateBlockNumber string `json:"stateBlockNumber"`
+	}{}
+	if err := json.Unmarshal(req.Params[0], &bundleArgs); err != nil {
+		return 0
+	}
+
+	if bundleArgs.StateBlockNumber != "" && bundleArgs.StateBlockNumber != "latest" && bundleArgs.StateBlockNumber != "pending" {
+		stateBlockNumber, err := parseHexUint64(bundleArgs.StateBlockNumber)
+		if err != nil {
+			return 0
+		}
+		return stateBlockNumber
+	}
+
+	blockNumber, err := parseHexUint64(bundleArgs.BlockNumber)
+	if err != nil || blockNumber == 0 {
+		return 0
+	}
+	return blockNumber - 1
+}
+
+// parseHexUint64 parses a JSON-RPC quantity like "0x1b4"
+func parseHexUint64(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequiredBlockNumber(t *testing.T) {
+	testCases := []struct {
+		payload  string
+		expected uint64
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"blockNumber":"0x64","stateBlockNumber":"latest"}]}`, 99},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"blockNumber":"0x64"}]}`, 99},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"blockNumber":"0x64","stateBlockNumber":"0x60"}]}`, 96},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"stateBlockNumber":"latest"}]}`, 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":["0x1"]}`, 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`, 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"blockNumber":"0x64"}]}`, 0},
+		{`foo`, 0},
+	}
+
+	for _, testCase := range testCases {
+		require.Equal(t, testCase.expected, ParseRequiredBlockNumber([]byte(testCase.payload)), testCase.payload)
+	}
+}
+
+func TestIsNotification(t *testing.T) {
+	require.True(t, IsNotification([]byte(`{"jsonrpc":"2.0","method":"eth_call"}`)))
+	require.False(t, IsNotification([]byte(`{"jsonrpc":"2.0","id":null,"method":"eth_call"}`)))
+	require.False(t, IsNotification([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call"}`)))
+	require.False(t, IsNotification([]byte(`foo`)))
+}
+
+func TestParseMethod(t *testing.T) {
+	require.Equal(t, "eth_callBundle", ParseMethod([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`)))
+	require.Equal(t, "", ParseMethod([]byte(`{"jsonrpc":"2.0","id":1}`)))
+	require.Equal(t, "", ParseMethod([]byte(`foo`)))
+}
+
+func TestParseID(t *testing.T) {
+	require.Equal(t, json.RawMessage(`1`), ParseID([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call"}`)))
+	require.Equal(t, json.RawMessage(`"a"`), ParseID([]byte(`{"jsonrpc":"2.0","id":"a","method":"eth_call"}`)))
+	require.Nil(t, ParseID([]byte(`{"jsonrpc":"2.0","method":"eth_call"}`)))
+	require.Nil(t, ParseID([]byte(`foo`)))
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "priolb"
+
+// Queue names, used as metrics label values
+const (
+	QueueNameFastTrack = "fast-track"
+	QueueNameHighPrio  = "high-prio"
+	QueueNameLowPrio   = "low-prio"
+)
+
+// Rejection reasons, used as metrics label values
+const (
+	RejectReasonQueueFull        = "queue_full"
+	RejectReasonRequestTimeout   = "request_timeout"
+	RejectReasonNodeTimeout      = "node_timeout"
+	RejectReasonNoNodes          = "no_nodes_available"
+	RejectReasonBlockNotAvail    = "block_not_available"
+	RejectReasonInvalidRequest   = "invalid_request"
+	RejectReasonMethodNotAllowed = "method_not_allowed"
+	RejectReasonLoadShed         = "load_shed"
+	RejectReasonUnauthorized     = "unauthorized"
+	RejectReasonQueueNotAllowed  = "queue_not_allowed"
+	RejectReasonQuotaExceeded    = "quota_exceeded"
+	RejectReasonRateLimited      = "rate_limited"
+)
+
+var circuitStateMetricValue = map[string]float64{CircuitClosed: 0, CircuitHalfOpen: 0.5, CircuitOpen: 1}
+
+var durationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metricQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_length",
+		Help:      "Number of requests waiting in the queue",
+	}, []string{"queue"})
+
+	metricQueueDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_duration_seconds",
+		Help:      "Time a request waited in the queue before being proxied",
+		Buckets:   durationBuckets,
+	}, []string{"queue"})
+
+	metricQueuePromotions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_promotions_total",
+		Help:      "Number of requests served ahead of the other classes because they waited longer than the aging threshold of their class",
+	}, []string{"queue"})
+
+	metricAdmissionSheddingLevel = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_shedding_level",
+		Help:      "Number of lowest priority queue classes whose new requests are shed because the queue delay is above the target",
+	})
+
+	metricSimDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sim_duration_seconds",
+		Help:      "Duration of the proxied request to the execution node",
+		Buckets:   durationBuckets,
+	}, []string{"queue"})
+
+	metricRequestsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_rejected_total",
+		Help:      "Number of requests rejected by the load balancer, by reason",
+	}, []string{"reason"})
+
+	metricNodeInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_requests_in_flight",
+		Help:      "Number of requests currently being proxied to a node",
+	}, []string{"node"})
+
+	metricNodeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_requests_total",
+		Help:      "Number of requests proxied to a node, by result (success, error or cancelled)",
+	}, []string{"node", "result"})
+
+	metricNodeHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_healthy",
+		Help:      "Whether a node is healthy according to the periodic health checks (1) or not (0)",
+	}, []string{"node"})
+
+	metricNodeCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_circuit_open",
+		Help:      "Circuit breaker state of a node: closed (0), half-open (0.5) or open (1)",
+	}, []string{"node"})
+
+	metricNodeBlockNumber = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_block_number",
+		Help:      "Latest block number reported by a node",
+	}, []string{"node"})
+
+	metricNodeBlockLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_block_lag",
+		Help:      "Number of blocks a node is behind the best head in the pool",
+	}, []string{"node"})
+
+	metricNodeConcurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_concurrency_limit",
+		Help:      "Current maximum number of concurrent requests to a node (adaptive concurrency limit, bounded by the number of workers)",
+	}, []string{"node"})
+
+	metricNodeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_retries_total",
+		Help:      "Number of requests that failed on a node and were put back into the queue",
+	}, []string{"node"})
+)
+
+// queueName returns the name of the queue a request belongs to
+func queueName(r *SimRequest) string {
+	if r.QueueClass != "" {
+		return r.QueueClass
+	} else if r.IsFastTrack {
+		return QueueNameFastTrack
+	} else if r.IsHighPrio {
+		return QueueNameHighPrio
+	}
+	return QueueNameLowPrio
+}
+
+// updateQueueMetrics sets the queue length gauges to the current queue sizes
+func updateQueueMetrics(q *PrioQueue) {
+	for name, numItems := range q.ClassLens() {
+		metricQueueLength.WithLabelValues(name).Set(float64(numItems))
+	}
+}
+
+// deleteNodeMetrics removes the metrics series of a node, i.e. when it's removed from the pool
+func deleteNodeMetrics(uri string) {
+	nodeLabel := nodeMetricsLabel(uri)
+	for _, metric := range []*prometheus.GaugeVec{metricNodeInFlight, metricNodeHealthy, metricNodeCircuitOpen, metricNodeBlockNumber, metricNodeBlockLag, metricNodeConcurrencyLimit} {
+		metric.DeleteLabelValues(nodeLabel)
+	}
+	metricNodeRequests.DeletePartialMatch(prometheus.Labels{"node": nodeLabel})
+	metricNodeRetries.DeleteLabelValues(nodeLabel)
+}
+
+// nodeMetricsLabel returns the node URI without user info and query, to keep attestation
+// measurements (SEV_/SGX_ user part) out of the metrics labels
+func nodeMetricsLabel(uri string) string {
+	pURL, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	pURL.User = nil
+	pURL.RawQuery = ""
+	return pURL.String()
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeMetricsLabel(t *testing.T) {
+	require.Equal(t, "http://localhost:8545", nodeMetricsLabel("http://localhost:8545"))
+	require.Equal(t, "http://localhost:8545", nodeMetricsLabel("http://localhost:8545?_workers=4"))
+	require.Equal(t, "https://foo", nodeMetricsLabel("https://SGX_abcdef@foo"))
+}
+
+func TestQueueMetrics(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false)
+	q.Push(NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false))
+	q.Push(NewSimRequest(context.Background(), "1", []byte("taskHighPrio"), true, false))
+	q.Push(NewSimRequest(context.Background(), "1", []byte("taskHighPrio"), true, false))
+	updateQueueMetrics(q)
+	require.Equal(t, float64(0), testutil.ToFloat64(metricQueueLength.WithLabelValues(QueueNameFastTrack)))
+	require.Equal(t, float64(2), testutil.ToFloat64(metricQueueLength.WithLabelValues(QueueNameHighPrio)))
+	require.Equal(t, float64(1), testutil.ToFloat64(metricQueueLength.WithLabelValues(QueueNameLowPrio)))
+}
+
+func TestDeleteNodeMetrics(t *testing.T) {
+	uri := "http://metrics-test-node:8545"
+	metricNodeHealthy.WithLabelValues(uri).Set(1)
+	metricNodeRequests.WithLabelValues(uri, "success").Inc()
+	metricNodeRequests.WithLabelValues(uri, "error").Inc()
+	metricNodeRequests.WithLabelValues("http://other-node:8545", "success").Inc()
+	numHealthy, numRequests := testutil.CollectAndCount(metricNodeHealthy), testutil.CollectAndCount(metricNodeRequests)
+
+	// All series of the node are removed, also with a node URI with query
+	deleteNodeMetrics(uri + "?_workers=4")
+	require.Equal(t, numHealthy-1, testutil.CollectAndCount(metricNodeHealthy))
+	require.Equal(t, numRequests-2, testutil.CollectAndCount(metricNodeRequests))
+}
@@ -3,10 +3,12 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,91 +16,673 @@ import (
 	"go.uber.org/zap"
 )
 
+// ewmaLatencyAlpha is the weight of the latest request duration in the EWMA latency of a node
+const ewmaLatencyAlpha = 0.3
+
 type Node struct {
 	log           *zap.SugaredLogger
 	URI           string
 	AddedAt       time.Time
 	jobC          chan *SimRequest
-	numWorkers    int32
+	numWorkers    int32 // target number of workers, can be changed at runtime with SetNumWorkers
 	curWorkers    int32
+	workersLock   sync.Mutex // serializes spawning and retiring workers
+	lastWorkerID  int32
 	cancelContext context.Context
 	cancelFunc    context.CancelFunc
 	client        *http.Client
+
+	circuitBreaker     *CircuitBreaker     // passive outlier detection based on the proxied requests
+	concurrencyLimiter *ConcurrencyLimiter // (optional) adaptive limit for concurrent requests
+
+	unhealthy             atomic.Bool // set by the health check loop, unhealthy nodes don't take jobs
+	healthLock            sync.Mutex
+	healthCheckSuccesses  int // consecutive successful health checks
+	healthCheckFailures   int // consecutive failed health checks
+	lastHealthCheckAt     time.Time
+	lastHealthCheckErrMsg string
+
+	blockNumber atomic.Uint64 // latest head reported by eth_blockNumber, 0 if unknown
+	blockLag    atomic.Uint64 // number of blocks behind the best head in the pool, set by the pool's head tracker
+	syncing     atomic.Bool   // whether eth_syncing reports the node as syncing
+	lagging     atomic.Bool   // set by the pool's head tracker, lagging nodes don't take jobs
+
+	stateChangedLock sync.Mutex
+	stateChangedC    chan struct{} // closed (and replaced) whenever the availability of the node changes
+	poolNotifyC      chan struct{} // (optional) signalled when the node has free capacity again or its availability changed
+
+	configLock sync.Mutex
+	config     NodeConfig
+
+	draining        atomic.Bool // draining nodes don't take new jobs, but finish the requests in flight
+	drainLock       sync.Mutex
+	drainStartedAt  time.Time
+	drainGeneration uint64 // incremented on every drain, so a stopped drain doesn't finish a later one
+	drainRemove     bool   // whether the node is removed from the pool once drained
+	drainWaiting    bool   // whether a NodePool.finishDrain is waiting for the drain
+
+	inFlight    atomic.Int32 // number of requests sent to the workers which are not finished yet
+	statsLock   sync.Mutex
+	ewmaLatency time.Duration // exponentially weighted moving average of the proxy request duration
+}
+
+// NodeInfo is the public state of a node, as returned by the API
+type NodeInfo struct {
+	NodeConfig
+	AddedAt              time.Time `json:"addedAt"`
+	NumWorkers           int32     `json:"numWorkers"`
+	CurWorkers           int32     `json:"curWorkers"`
+	ConcurrencyLimit     int32     `json:"concurrencyLimit"`
+	InFlight             int32     `json:"inFlight"`
+	EWMALatencyMs        float64   `json:"ewmaLatencyMs"`
+	Healthy              bool      `json:"healthy"`
+	CircuitState         string    `json:"circuitState"`
+	BlockNumber          uint64    `json:"blockNumber"`
+	BlockLag             uint64    `json:"blockLag"`
+	Syncing              bool      `json:"syncing"`
+	Draining             bool      `json:"draining"`
+	DrainingSince        time.Time `json:"drainingSince"`
+	LastHealthCheckAt    time.Time `json:"lastHealthCheckAt"`
+	LastHealthCheckError string    `json:"lastHealthCheckError,omitempty"`
+}
+
+// Info returns the current public state of the node
+func (n *Node) Info() NodeInfo {
+	n.drainLock.Lock()
+	drainStartedAt := n.drainStartedAt
+	n.drainLock.Unlock()
+
+	n.healthLock.Lock()
+	defer n.healthLock.Unlock()
+	return NodeInfo{
+		NodeConfig:           n.Config(),
+		AddedAt:              n.AddedAt,
+		NumWorkers:           atomic.LoadInt32(&n.numWorkers),
+		CurWorkers:           atomic.LoadInt32(&n.curWorkers),
+		ConcurrencyLimit:     n.concurrencyLimit(),
+		InFlight:             n.inFlight.Load(),
+		EWMALatencyMs:        float64(n.latency().Microseconds()) / 1000,
+		Healthy:              n.IsHealthy(),
+		CircuitState:         n.circuitBreaker.State(),
+		BlockNumber:          n.blockNumber.Load(),
+		BlockLag:             n.blockLag.Load(),
+		Syncing:              n.syncing.Load(),
+		Draining:             n.IsDraining(),
+		DrainingSince:        drainStartedAt,
+		LastHealthCheckAt:    n.lastHealthCheckAt,
+		LastHealthCheckError: n.lastHealthCheckErrMsg,
+	}
+}
+
+// Config returns the node configuration
+func (n *Node) Config() NodeConfig {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+	config := n.config
+	config.URI = n.URI
+	return config
+}
+
+// SetConfig updates the node configuration (the number of workers is set when creating the node)
+func (n *Node) SetConfig(config NodeConfig) {
+	n.configLock.Lock()
+	n.config = config
+	n.configLock.Unlock()
+	n.notifyStateChanged()
+}
+
+// IsEnabled returns false if the node was disabled in its config
+func (n *Node) IsEnabled() bool {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+	return n.config.IsEnabled()
+}
+
+// HasLabels returns true if the node labels match one of the label sets (or no label sets are given)
+func (n *Node) HasLabels(labelSets []map[string]string) bool {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+	return labelsMatch(n.config.Labels, labelSets)
+}
+
+// AcceptsPayload returns false if the payload is larger than the max payload size of the node
+func (n *Node) AcceptsPayload(size int) bool {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+	return n.config.MaxPayloadSize == 0 || size <= n.config.MaxPayloadSize
 }
 
 func (n *Node) HealthCheck() error {
-	payload := `{"jsonrpc":"2.0","method":"net_version","params":[],"id":123}`
-	_, _, err := n.ProxyRequest(context.Background(), []byte(payload), 5*time.Second)
+	payload := fmt.Sprintf(`{"jsonrpc":"2.0","method":"%s","params":[],"id":123}`, HealthCheckMethod)
+	_, _, err := n.ProxyRequest(context.Background(), []byte(payload), HealthCheckTimeout)
 	return err
 }
 
+// callRPC sends a JSON-RPC request without params to the node and returns the result
+func (n *Node) callRPC(method string, timeout time.Duration) (json.RawMessage, error) {
+	payload := fmt.Sprintf(`{"jsonrpc":"2.0","method":"%s","params":[],"id":1}`, method)
+	respBytes, _, err := n.ProxyRequest(context.Background(), []byte(payload), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(JSONRPCResponse)
+	if err = json.Unmarshal(respBytes, resp); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s response failed", method)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// UpdateHead fetches the current head (eth_blockNumber) and sync status (eth_syncing) of the node
+func (n *Node) UpdateHead() error {
+	res, err := n.callRPC("eth_blockNumber", HealthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	var blockNumberHex string
+	if err = json.Unmarshal(res, &blockNumberHex); err != nil {
+		return errors.Wrap(err, "decoding eth_blockNumber result failed")
+	}
+	blockNumber, err := parseHexUint64(blockNumberHex)
+	if err != nil {
+		return errors.Wrap(err, "parsing eth_blockNumber result failed")
+	}
+
+	res, err = n.callRPC("eth_syncing", HealthCheckTimeout)
+	if err != nil {
+		return err
+	}
+
+	n.blockNumber.Store(blockNumber)
+	n.syncing.Store(string(res) != "false") // eth_syncing returns false, or an object with the sync progress
+	metricNodeBlockNumber.WithLabelValues(nodeMetricsLabel(n.URI)).Set(float64(blockNumber))
+	return nil
+}
+
+// HasBlock returns true if the node has imported the given block (always true for block 0)
+func (n *Node) HasBlock(blockNumber uint64) bool {
+	return n.blockNumber.Load() >= blockNumber
+}
+
+// setBlockLag stores the lag behind the best head of the pool, and wakes up the workers if the node starts or stops lagging
+func (n *Node) setBlockLag(blockLag uint64, isLagging bool) {
+	n.blockLag.Store(blockLag)
+	metricNodeBlockLag.WithLabelValues(nodeMetricsLabel(n.URI)).Set(float64(blockLag))
+	if n.lagging.Swap(isLagging) != isLagging {
+		if isLagging {
+			n.log.Warnw("node is lagging behind, not taking jobs", "uri", n.URI, "blockNumber", n.blockNumber.Load(), "blockLag", blockLag, "syncing", n.syncing.Load())
+		} else {
+			n.log.Infow("node caught up, taking jobs again", "uri", n.URI, "blockNumber", n.blockNumber.Load())
+		}
+		n.notifyStateChanged()
+	}
+}
+
+// IsHealthy returns false if the node was marked unhealthy by the health check loop
+func (n *Node) IsHealthy() bool {
+	return !n.unhealthy.Load()
+}
+
+// IsAvailable returns true if the node workers may take new jobs
+func (n *Node) IsAvailable() bool {
+	return n.IsEnabled() && n.IsHealthy() && !n.IsDraining() && !n.lagging.Load() && n.circuitBreaker.State() != CircuitOpen
+}
+
+// IsDraining returns true if the node is being drained (see StartDrain)
+func (n *Node) IsDraining() bool {
+	return n.draining.Load()
+}
+
+// StartDrain stops the node from taking new jobs, while the requests in flight are finished. With remove, the
+// node is to be removed once drained (also if it was already draining). Returns the generation of the drain, and
+// whether the caller needs to wait for it to finish (false if somebody is waiting already).
+func (n *Node) StartDrain(remove bool) (generation uint64, wait bool) {
+	n.drainLock.Lock()
+	defer n.drainLock.Unlock()
+	if n.draining.Load() {
+		n.drainRemove = n.drainRemove || remove
+		wait = remove && !n.drainWaiting
+		n.drainWaiting = n.drainWaiting || wait
+		return n.drainGeneration, wait
+	}
+
+	n.drainGeneration += 1
+	n.drainRemove = remove
+	n.drainWaiting = true
+	n.drainStartedAt = time.Now().UTC()
+	n.draining.Store(true)
+	n.log.Infow("node draining", "uri", n.URI, "inFlight", n.inFlight.Load(), "remove", remove)
+	n.notifyStateChanged()
+	return n.drainGeneration, true
+}
+
+// drainOngoing returns whether the drain of the given generation was not stopped
+func (n *Node) drainOngoing(generation uint64) bool {
+	n.drainLock.Lock()
+	defer n.drainLock.Unlock()
+	return n.draining.Load() && n.drainGeneration == generation
+}
+
+// endDrainWait is called when the wait for a drain ends. Returns whether the drain of the given generation is
+// still ongoing, and if the node is to be removed.
+func (n *Node) endDrainWait(generation uint64) (ongoing, remove bool) {
+	n.drainLock.Lock()
+	defer n.drainLock.Unlock()
+	if n.drainGeneration != generation {
+		return false, false // a later drain has its own wait
+	}
+	n.drainWaiting = false
+	return n.draining.Load(), n.drainRemove
+}
+
+// StopDrain lets a draining node take jobs again
+func (n *Node) StopDrain() {
+	n.drainLock.Lock()
+	defer n.drainLock.Unlock()
+	if !n.draining.Load() {
+		return
+	}
+
+	n.drainStartedAt = time.Time{}
+	n.draining.Store(false)
+	n.log.Infow("node drain stopped, taking jobs again", "uri", n.URI)
+	n.notifyStateChanged()
+}
+
+// NumInFlight returns the number of requests which were sent to the workers and are not finished yet
+func (n *Node) NumInFlight() int32 {
+	return n.inFlight.Load()
+}
+
+// stateChanged returns a channel which is closed on the next availability change of the node
+func (n *Node) stateChanged() <-chan struct{} {
+	n.stateChangedLock.Lock()
+	defer n.stateChangedLock.Unlock()
+	if n.stateChangedC == nil {
+		n.stateChangedC = make(chan struct{})
+	}
+	return n.stateChangedC
+}
+
+// notifyStateChanged wakes up all workers, so they re-check whether the node is available
+func (n *Node) notifyStateChanged() {
+	n.stateChangedLock.Lock()
+	if n.stateChangedC != nil {
+		close(n.stateChangedC)
+	}
+	n.stateChangedC = make(chan struct{})
+	n.stateChangedLock.Unlock()
+	n.notifyPool()
+}
+
+// notifyPool signals the node pool that it may be able to dispatch requests to this node
+func (n *Node) notifyPool() {
+	select {
+	case n.poolNotifyC <- struct{}{}:
+	default:
+	}
+}
+
+// capacity returns the maximum number of concurrent requests for this node
+func (n *Node) capacity() int32 {
+	if n.circuitBreaker.State() == CircuitHalfOpen {
+		return 1 // only the trial request
+	}
+	return n.concurrencyLimit()
+}
+
+// concurrencyLimit returns the adaptive concurrency limit, bounded by the number of workers
+func (n *Node) concurrencyLimit() int32 {
+	numWorkers := atomic.LoadInt32(&n.numWorkers)
+	if limit := n.concurrencyLimiter.Limit(); limit >= 0 && limit < numWorkers {
+		return limit
+	}
+	return numWorkers
+}
+
+// HasCapacity returns true if the node can take another request without waiting
+func (n *Node) HasCapacity() bool {
+	return n.inFlight.Load() < n.capacity()
+}
+
+// reserve claims a slot for a request which is about to be sent to a worker. Returns false if the node
+// is at capacity. The worker releases the slot when done, or the caller if the request wasn't taken.
+func (n *Node) reserve() bool {
+	for {
+		inFlight := n.inFlight.Load()
+		if inFlight >= n.capacity() {
+			return false
+		}
+		if n.inFlight.CompareAndSwap(inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+// release frees a slot claimed with reserve
+func (n *Node) release() {
+	n.inFlight.Add(-1)
+}
+
+// load returns the number of in-flight requests relative to the capacity
+func (n *Node) load() float64 {
+	capacity := n.capacity()
+	if capacity <= 0 {
+		return 1
+	}
+	return float64(n.inFlight.Load()) / float64(capacity)
+}
+
+// Weight returns the share of requests the node should get in relation to other nodes (default: number of workers)
+func (n *Node) Weight() int {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+	if n.config.Weight > 0 {
+		return n.config.Weight
+	}
+	return int(atomic.LoadInt32(&n.numWorkers))
+}
+
+// latency returns the EWMA of the proxy request durations
+func (n *Node) latency() time.Duration {
+	n.statsLock.Lock()
+	defer n.statsLock.Unlock()
+	return n.ewmaLatency
+}
+
+// expectedLatency estimates how long a new request would take, based on the latency and in-flight requests
+func (n *Node) expectedLatency() time.Duration {
+	return n.latency() * time.Duration(n.inFlight.Load()+1)
+}
+
+// recordLatency updates the EWMA latency with the duration of a proxy request
+func (n *Node) recordLatency(d time.Duration) {
+	n.statsLock.Lock()
+	defer n.statsLock.Unlock()
+	if n.ewmaLatency == 0 {
+		n.ewmaLatency = d
+	} else {
+		n.ewmaLatency = time.Duration(ewmaLatencyAlpha*float64(d) + (1-ewmaLatencyAlpha)*float64(n.ewmaLatency))
+	}
+}
+
+// updateHealth records the result of a health check, and marks the node unhealthy or healthy again
+// once the respective threshold of consecutive results is reached.
+func (n *Node) updateHealth(err error) {
+	n.healthLock.Lock()
+	defer n.healthLock.Unlock()
+
+	n.lastHealthCheckAt = time.Now().UTC()
+	if err != nil {
+		n.lastHealthCheckErrMsg = err.Error()
+		n.healthCheckSuccesses = 0
+		n.healthCheckFailures += 1
+		if n.IsHealthy() && n.healthCheckFailures >= HealthCheckUnhealthyThreshold {
+			n.log.Warnw("node marked unhealthy", "uri", n.URI, "failures", n.healthCheckFailures, "error", err)
+			n.unhealthy.Store(true)
+			n.notifyStateChanged()
+		}
+	} else {
+		n.lastHealthCheckErrMsg = ""
+		n.healthCheckFailures = 0
+		n.healthCheckSuccesses += 1
+		if !n.IsHealthy() && n.healthCheckSuccesses >= HealthCheckHealthyThreshold {
+			n.log.Infow("node is healthy again", "uri", n.URI, "successes", n.healthCheckSuccesses)
+			n.unhealthy.Store(false)
+			n.notifyStateChanged()
+		}
+	}
+
+	healthy := 0.0
+	if n.IsHealthy() {
+		healthy = 1
+	}
+	metricNodeHealthy.WithLabelValues(nodeMetricsLabel(n.URI)).Set(healthy)
+}
+
+// startHealthCheckLoop runs the health check every HealthCheckInterval until the context is cancelled
+func (n *Node) startHealthCheckLoop(cancelContext context.Context) {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.updateHealth(n.HealthCheck())
+		case <-cancelContext.Done():
+			return
+		}
+	}
+}
+
 func (n *Node) startProxyWorker(id int32, cancelContext context.Context) {
 	log := n.log.With(
 		"uri", n.URI,
 		"id", id,
 	)
 	log.Infow("starting proxy node worker")
-	atomic.AddInt32(&n.curWorkers, 1)
-	defer atomic.AddInt32(&n.curWorkers, -1)
 
 	for {
-		select {
-		case req := <-n.jobC:
-			_log := log.With("reqID", req.ID)
-			_log.Debug("processing request")
-
-			if req.Cancelled {
-				_log.Info("request was cancelled before processing")
-				continue
-			}
+		// Retire this worker if the number of workers was reduced (only between jobs)
+		if n.retireWorker() {
+			log.Infow("node worker retired")
+			return
+		}
 
-			if time.Since(req.CreatedAt) > RequestTimeout {
-				_log.Info("request timed out before processing")
-				req.SendResponse(SimResponse{Error: ErrRequestTimeout})
-				continue
-			}
+		// Don't take any jobs while the node is not available (a nil channel blocks forever). With a
+		// half-open circuit breaker, only the worker holding the trial takes a job.
+		stateChangedC := n.stateChanged()
+		jobC := n.jobC
+		isTrial := false
+		if !n.IsAvailable() {
+			jobC = nil
+		} else if allowed, trial := n.circuitBreaker.Allow(); !allowed {
+			jobC = nil
+		} else {
+			isTrial = trial
+		}
 
-			req.Tries += 1
-			timeBeforeProxy := time.Now().UTC()
-			payload, statusCode, err := n.ProxyRequest(req.Context, req.Payload, ProxyRequestTimeout)
-			requestDuration := time.Since(timeBeforeProxy)
-			_log = _log.With("requestDurationUS", requestDuration.Microseconds())
-			if err != nil {
-				// if not context deadline exceeded
-				if errors.Is(err, context.DeadlineExceeded) {
-					_log.Infow("node proxyRequest error: context deatline exeeded", "uri", n.URI, "error", err)
-				} else {
-					_log.Errorw("node proxyRequest error", "uri", n.URI, "error", err)
-				}
-				response := SimResponse{StatusCode: statusCode, Payload: payload, Error: err, ShouldRetry: true, NodeURI: n.URI}
-				req.SendResponse(response)
-				continue
+		select {
+		case <-stateChangedC:
+			if isTrial {
+				n.cancelCircuitTrial()
 			}
+			continue
 
-			// Send response
-			_log.Debug("request processed, sending response")
-			sent := req.SendResponse(SimResponse{Payload: payload, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy})
-			if !sent {
-				_log.Errorw("couldn't send node response to client (SendResponse returned false)", "secSinceRequestCreated", time.Since(req.CreatedAt).Seconds())
+		case req := <-jobC:
+			wasProxied := n.processRequest(log, req)
+			if isTrial && !wasProxied {
+				n.cancelCircuitTrial()
 			}
+			n.release() // slot was reserved by the sender
+			n.notifyPool()
 
 		case <-cancelContext.Done():
+			if isTrial {
+				n.cancelCircuitTrial()
+			}
+			atomic.AddInt32(&n.curWorkers, -1)
 			log.Infow("node worker stopped")
 			return
 		}
 	}
 }
 
-// StartWorkers spawns the proxy workers in goroutines. Workers that are already running will be cancelled.
+// processRequest proxies a request to the node and sends the response. Returns false if the request
+// was not proxied (i.e. cancelled or timed out before processing).
+func (n *Node) processRequest(log *zap.SugaredLogger, req *SimRequest) (wasProxied bool) {
+	log = log.With("reqID", req.ID)
+	log.Debug("processing request")
+
+	if req.IsCancelled() {
+		log.Info("request was cancelled before processing")
+		return false
+	}
+
+	if req.DeadlineExceeded(n.latency()) {
+		log.Infow("request timed out before processing", "deadline", req.Deadline, "latency", n.latency())
+		metricRequestsRejected.WithLabelValues(RejectReasonRequestTimeout).Inc()
+		req.SendResponse(SimResponse{Error: ErrRequestTimeout})
+		return false
+	}
+
+	// Send the request back to the queue if this node doesn't have the requested block anymore (i.e. after a reorg
+	// since it was selected). Counts as a try, the queue then holds the request until a node has the block.
+	if !n.HasBlock(req.MinBlockNumber) {
+		log.Debugw("node doesn't have the requested block yet", "minBlockNumber", req.MinBlockNumber, "blockNumber", n.blockNumber.Load())
+		req.Tries += 1
+		req.SendResponse(SimResponse{Error: ErrBlockNotAvailable, ShouldRetry: true, NodeURI: n.URI})
+		return false
+	}
+
+	nodeLabel := nodeMetricsLabel(n.URI)
+	req.Tries += 1
+	timeBeforeProxy := time.Now().UTC()
+	metricNodeInFlight.WithLabelValues(nodeLabel).Inc()
+	payload, statusCode, err := n.ProxyRequest(req.Context, req.Payload, ProxyRequestTimeout)
+	metricNodeInFlight.WithLabelValues(nodeLabel).Dec()
+	requestDuration := time.Since(timeBeforeProxy)
+	log = log.With("requestDurationUS", requestDuration.Microseconds())
+	n.recordCircuitResult(isNodeFailure(statusCode, err))
+	if err == nil || isNodeFailure(statusCode, err) {
+		n.recordConcurrencyResult(requestDuration, err != nil)
+	}
+	if err == nil {
+		n.recordLatency(requestDuration)
+	}
+	if err != nil && req.IsCancelled() {
+		log.Info("request was cancelled while proxying")
+		metricNodeRequests.WithLabelValues(nodeLabel, "cancelled").Inc()
+		return true
+	}
+	if err != nil {
+		// if not context deadline exceeded
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Infow("node proxyRequest error: context deatline exeeded", "uri", n.URI, "error", err)
+		} else {
+			log.Errorw("node proxyRequest error", "uri", n.URI, "error", err)
+		}
+		metricNodeRequests.WithLabelValues(nodeLabel, "error").Inc()
+		response := SimResponse{StatusCode: statusCode, Payload: payload, Error: err, ShouldRetry: true, NodeURI: n.URI}
+		req.SendResponse(response)
+		return true
+	}
+
+	// Send response
+	metricNodeRequests.WithLabelValues(nodeLabel, "success").Inc()
+	log.Debug("request processed, sending response")
+	sent := req.SendResponse(SimResponse{Payload: payload, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy})
+	if !sent {
+		log.Errorw("couldn't send node response to client (SendResponse returned false)", "secSinceRequestCreated", time.Since(req.CreatedAt).Seconds())
+	}
+	return true
+}
+
+// isNodeFailure returns whether a proxy result counts as failure of the node for the circuit breaker
+// (connection errors, 5xx responses and timeouts, but not cancellation by the client or 4xx responses)
+func isNodeFailure(statusCode int, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return statusCode == 0 || statusCode >= 500
+}
+
+// recordCircuitResult feeds a request result into the circuit breaker, and wakes up the workers if the state changed
+func (n *Node) recordCircuitResult(failed bool) {
+	newState, changed := n.circuitBreaker.RecordResult(failed)
+	if !changed {
+		return
+	}
+
+	metricNodeCircuitOpen.WithLabelValues(nodeMetricsLabel(n.URI)).Set(circuitStateMetricValue[newState])
+	if newState == CircuitOpen {
+		n.log.Warnw("node circuit breaker opened", "uri", n.URI, "backoff", n.circuitBreaker.backoff)
+		time.AfterFunc(n.circuitBreaker.backoff, n.notifyStateChanged) // let a worker pick up the trial request after the backoff
+	} else {
+		n.log.Infow("node circuit breaker state changed", "uri", n.URI, "state", newState)
+	}
+	n.notifyStateChanged()
+}
+
+// recordConcurrencyResult feeds a request result into the adaptive concurrency limiter
+func (n *Node) recordConcurrencyResult(latency time.Duration, failed bool) {
+	prevLimit := n.concurrencyLimit()
+	if _, changed := n.concurrencyLimiter.RecordResult(latency, failed); !changed {
+		return
+	}
+
+	limit := n.concurrencyLimit()
+	metricNodeConcurrencyLimit.WithLabelValues(nodeMetricsLabel(n.URI)).Set(float64(limit))
+	if limit != prevLimit {
+		n.log.Debugw("node concurrency limit changed", "uri", n.URI, "limit", limit, "prevLimit", prevLimit)
+	}
+	if limit > prevLimit {
+		n.notifyPool() // more requests can be dispatched to this node
+	}
+}
+
+// cancelCircuitTrial gives back an unused half-open trial, and lets another worker pick it up
+func (n *Node) cancelCircuitTrial() {
+	n.circuitBreaker.CancelTrial()
+	n.notifyStateChanged()
+}
+
+// StartWorkers spawns the proxy workers and the health check loop in goroutines. Workers that are already running will be cancelled.
 func (n *Node) StartWorkers() {
 	if n.cancelFunc != nil {
 		n.cancelFunc()
 	}
 
 	n.cancelContext, n.cancelFunc = context.WithCancel(context.Background())
-	for i := int32(0); i < n.numWorkers; i++ {
-		go n.startProxyWorker(i+1, n.cancelContext)
+	n.workersLock.Lock()
+	n._spawnWorkers(atomic.LoadInt32(&n.numWorkers))
+	n.workersLock.Unlock()
+
+	if HealthCheckInterval > 0 {
+		go n.startHealthCheckLoop(n.cancelContext)
+	}
+}
+
+// _spawnWorkers starts additional proxy workers (workersLock must be held)
+func (n *Node) _spawnWorkers(num int32) {
+	for i := int32(0); i < num; i++ {
+		n.lastWorkerID += 1
+		atomic.AddInt32(&n.curWorkers, 1) // decremented by the worker when it stops
+		go n.startProxyWorker(n.lastWorkerID, n.cancelContext)
+	}
+}
+
+// retireWorker returns true if the calling worker should stop because there are more workers than configured
+func (n *Node) retireWorker() bool {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	if atomic.LoadInt32(&n.curWorkers) <= atomic.LoadInt32(&n.numWorkers) {
+		return false
+	}
+	atomic.AddInt32(&n.curWorkers, -1)
+	return true
+}
+
+// SetNumWorkers changes the number of workers at runtime. Additional workers are spawned right away,
+// surplus workers are retired once they finished their current request.
+func (n *Node) SetNumWorkers(numWorkers int32) {
+	prevNumWorkers := atomic.SwapInt32(&n.numWorkers, numWorkers)
+	if prevNumWorkers == numWorkers {
+		return
+	}
+
+	n.log.Infow("changing number of node workers", "uri", n.URI, "prevNumWorkers", prevNumWorkers, "numWorkers", numWorkers)
+	n.concurrencyLimiter.SetMaxLimit(maxConcurrencyLimit(numWorkers))
+	n.workersLock.Lock()
+	isStarted := n.cancelContext != nil && n.cancelContext.Err() == nil
+	if numMissing := numWorkers - atomic.LoadInt32(&n.curWorkers); isStarted && numMissing > 0 {
+		n._spawnWorkers(numMissing)
 	}
+	n.workersLock.Unlock()
+	n.notifyStateChanged() // wakes up idle workers to retire, and the pool to use the new capacity
 }
 
 func (n *Node) StopWorkers() {
@@ -110,7 +694,7 @@ func (n *Node) StopWorkers() {
 func (n *Node) StopWorkersAndWait() {
 	n.StopWorkers()
 	for {
-		if n.curWorkers == 0 {
+		if atomic.LoadInt32(&n.curWorkers) == 0 {
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -12,7 +12,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorkers int32) (*Node, error) {
+func NewNode(log *zap.SugaredLogger, uri string, numWorkers int32) (*Node, error) {
 	pURL, err := url.ParseRequestURI(uri)
 	if err != nil {
 		return nil, err
@@ -34,8 +34,11 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 		log:        log,
 		URI:        uri,
 		AddedAt:    time.Now(),
-		jobC:       jobC,
+		jobC:       make(chan *SimRequest), // unbuffered: Dispatch hands each request directly to a worker
 		numWorkers: numWorkers,
+
+		circuitBreaker:     NewCircuitBreaker(CircuitBreakerFailures, CircuitBreakerWindow, CircuitBreakerBackoff),
+		concurrencyLimiter: newNodeConcurrencyLimiter(numWorkers),
 		client: &http.Client{
 			Timeout: ProxyRequestTimeout,
 			Transport: &http.Transport{
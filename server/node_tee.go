@@ -44,7 +44,7 @@ func (w attestationLogger) Warnf(format string, args ...any) {
 	w.log.Warnw(fmt.Sprintf(format, args...))
 }
 
-func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorkers int32) (*Node, error) {
+func NewNode(log *zap.SugaredLogger, uri string, numWorkers int32) (*Node, error) {
 	client := http.Client{}
 	pURL, err := url.ParseRequestURI(uri)
 	if err != nil {
@@ -124,9 +124,12 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 		log:        log,
 		URI:        uri,
 		AddedAt:    time.Now(),
-		jobC:       jobC,
+		jobC:       make(chan *SimRequest), // unbuffered: Dispatch hands each request directly to a worker
 		numWorkers: numWorkers,
-		client:     &client,
+
+		circuitBreaker:     NewCircuitBreaker(CircuitBreakerFailures, CircuitBreakerWindow, CircuitBreakerBackoff),
+		concurrencyLimiter: newNodeConcurrencyLimiter(numWorkers),
+		client:             &client,
 	}
 	return node, nil
 }
@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,12 +13,25 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// trySendJob sends a request to a worker of the node, like NodePool.Dispatch does
+func trySendJob(node *Node, req *SimRequest, timeout time.Duration) bool {
+	if !node.reserve() {
+		return false
+	}
+	select {
+	case node.jobC <- req:
+		return true
+	case <-time.After(timeout):
+		node.release()
+		return false
+	}
+}
+
 func TestNode(t *testing.T) {
 	mockNodeBackend1 := testutils.NewMockNodeBackend()
 	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(mockNodeBackend1.Handler))
 
-	jobC := make(chan *SimRequest)
-	node, err := NewNode(testLog, mockNodeServer1.URL, jobC, 1)
+	node, err := NewNode(testLog, mockNodeServer1.URL, 1)
 	require.Nil(t, err, err)
 
 	err = node.HealthCheck()
@@ -24,7 +39,7 @@ func TestNode(t *testing.T) {
 
 	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
 	node.StartWorkers()
-	node.jobC <- request
+	require.True(t, trySendJob(node, request, time.Second))
 	res := <-request.ResponseC
 	require.NotNil(t, res, res)
 	require.Nil(t, res.Error, res.Error)
@@ -32,7 +47,7 @@ func TestNode(t *testing.T) {
 	require.Equal(t, int32(0), node.curWorkers)
 
 	// Invalid backend -> fail healthcheck
-	node, err = NewNode(testLog, "http://localhost:4831", nil, 1)
+	node, err = NewNode(testLog, "http://localhost:4831", 1)
 	require.Nil(t, err, err)
 
 	err = node.HealthCheck()
@@ -46,8 +61,7 @@ func TestNodeError(t *testing.T) {
 		http.Error(w, "error", 479)
 	}
 
-	jobC := make(chan *SimRequest)
-	node, err := NewNode(testLog, mockNodeServer.URL, jobC, 1)
+	node, err := NewNode(testLog, mockNodeServer.URL, 1)
 	require.Nil(t, err, err)
 
 	// Check failing healthcheck
@@ -63,7 +77,7 @@ func TestNodeError(t *testing.T) {
 	// Check failing SimRequest
 	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
 	node.StartWorkers()
-	node.jobC <- request
+	require.True(t, trySendJob(node, request, time.Second))
 	res := <-request.ResponseC
 	require.NotNil(t, res, res)
 	require.NotNil(t, res.Error, res.Error)
@@ -75,19 +89,145 @@ func TestNodeError(t *testing.T) {
 func TestWorkersArg(t *testing.T) {
 	mockNodeBackend1 := testutils.NewMockNodeBackend()
 	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(mockNodeBackend1.Handler))
-	jobC := make(chan *SimRequest)
 
-	node, err := NewNode(testLog, mockNodeServer1.URL, jobC, 1)
+	node, err := NewNode(testLog, mockNodeServer1.URL, 1)
 	require.Nil(t, err, err)
 	require.Equal(t, int32(1), node.numWorkers)
 
 	uriWithWorkers := mockNodeServer1.URL + "?_workers=4"
-	node, err = NewNode(testLog, uriWithWorkers, jobC, 1)
+	node, err = NewNode(testLog, uriWithWorkers, 1)
 	require.Nil(t, err, err)
 	require.Equal(t, int32(4), node.numWorkers)
 
 	uriWithWorkers = mockNodeServer1.URL + "?_workers=6"
-	node, err = NewNode(testLog, uriWithWorkers, jobC, 1)
+	node, err = NewNode(testLog, uriWithWorkers, 1)
 	require.Nil(t, err, err)
 	require.Equal(t, int32(6), node.numWorkers)
 }
+
+func TestNodeHealthCheckLoop(t *testing.T) {
+	origInterval, origUnhealthy, origHealthy := HealthCheckInterval, HealthCheckUnhealthyThreshold, HealthCheckHealthyThreshold
+	HealthCheckInterval, HealthCheckUnhealthyThreshold, HealthCheckHealthyThreshold = 10*time.Millisecond, 2, 2
+	defer func() {
+		HealthCheckInterval, HealthCheckUnhealthyThreshold, HealthCheckHealthyThreshold = origInterval, origUnhealthy, origHealthy
+	}()
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	node, err := NewNode(testLog, mockNodeServer.URL, 1)
+	require.Nil(t, err, err)
+	require.True(t, node.IsHealthy())
+
+	// A single failure doesn't mark the node unhealthy
+	node.updateHealth(errors.New("fail"))
+	require.True(t, node.IsHealthy())
+	node.updateHealth(nil)
+	node.updateHealth(errors.New("fail"))
+	require.True(t, node.IsHealthy())
+
+	// Backend starts failing -> node gets ejected
+	mockNodeBackend.SetHTTPHandlerOverride(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", 479)
+	})
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+	require.Eventually(t, func() bool { return !node.IsHealthy() }, time.Second, 5*time.Millisecond)
+	require.Contains(t, node.Info().LastHealthCheckError, "479")
+
+	// Unhealthy node doesn't take jobs
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.False(t, trySendJob(node, request, 100*time.Millisecond), "unhealthy node should not take jobs")
+
+	// Backend recovers -> node gets re-admitted and takes jobs again
+	mockNodeBackend.Reset()
+	require.Eventually(t, node.IsHealthy, time.Second, 5*time.Millisecond)
+	require.Equal(t, "", node.Info().LastHealthCheckError)
+	require.True(t, trySendJob(node, request, time.Second))
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+}
+
+func TestNodeCircuitBreaker(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	node, err := NewNode(testLog, mockNodeServer.URL, 1)
+	require.Nil(t, err, err)
+	node.circuitBreaker = NewCircuitBreaker(2, 2, 100*time.Millisecond)
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+
+	// 4xx responses don't count as node failures
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", 479)
+	}
+	for i := 0; i < 3; i++ {
+		request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+		require.True(t, trySendJob(node, request, time.Second))
+		<-request.ResponseC
+	}
+	require.Equal(t, CircuitClosed, node.circuitBreaker.State())
+
+	// 5xx responses open the circuit
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", http.StatusBadGateway)
+	}
+	for i := 0; i < 2; i++ {
+		request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+		require.True(t, trySendJob(node, request, time.Second))
+		<-request.ResponseC
+	}
+	require.Equal(t, CircuitOpen, node.circuitBreaker.State())
+	require.False(t, node.IsAvailable())
+
+	// Node with open circuit doesn't take jobs
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.False(t, trySendJob(node, request, 50*time.Millisecond), "node with open circuit should not take jobs")
+
+	// After the backoff, a successful trial request closes the circuit
+	mockNodeBackend.Reset()
+	require.True(t, trySendJob(node, request, time.Second), "node should take a trial request after the backoff")
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, CircuitClosed, node.circuitBreaker.State())
+}
+
+func TestNodeSetNumWorkers(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	node, err := NewNode(testLog, mockNodeServer.URL, 2)
+	require.Nil(t, err, err)
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.curWorkers) == 2 }, time.Second, 5*time.Millisecond)
+
+	// Spawn additional workers
+	node.SetNumWorkers(4)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.curWorkers) == 4 }, time.Second, 5*time.Millisecond)
+
+	// Keep all workers busy
+	unblockC := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		<-unblockC
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+	}
+	requests := []*SimRequest{}
+	for i := 0; i < 4; i++ {
+		request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+		require.True(t, trySendJob(node, request, time.Second))
+		requests = append(requests, request)
+	}
+
+	// Surplus workers are retired only after finishing their request
+	node.SetNumWorkers(1)
+	require.Equal(t, int32(4), atomic.LoadInt32(&node.curWorkers))
+	close(unblockC)
+	for _, request := range requests {
+		res := <-request.ResponseC
+		require.Nil(t, res.Error, res.Error)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.curWorkers) == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(1), node.Info().NumWorkers)
+}
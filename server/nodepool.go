@@ -1,27 +1,44 @@
 package server
 
 import (
+	"context"
+	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// drainCheckInterval is how often a draining node is checked for requests in flight
+var drainCheckInterval = 20 * time.Millisecond
+
 type NodePool struct {
 	log               *zap.SugaredLogger
 	nodes             []*Node
 	nodesLock         sync.Mutex
 	redisState        *RedisState
 	numWorkersPerNode int32
-	JobC              chan *SimRequest
+	balancer          Balancer
+	notifyC           chan struct{} // signalled by nodes when they have free capacity again or their availability changed
+
+	bestHead      atomic.Uint64 // best head of all nodes, set by UpdateHeads
+	cancelContext context.Context
+	cancelFunc    context.CancelFunc
 }
 
 func NewNodePool(log *zap.SugaredLogger, redisState *RedisState, numWorkersPerNode int32) *NodePool {
+	cancelContext, cancelFunc := context.WithCancel(context.Background())
 	return &NodePool{
 		log:               log,
 		redisState:        redisState,
 		numWorkersPerNode: numWorkersPerNode,
-		JobC:              make(chan *SimRequest, JobChannelBuffer),
+		balancer:          &LeastInFlightBalancer{},
+		notifyC:           make(chan struct{}, 1),
+		cancelContext:     cancelContext,
+		cancelFunc:        cancelFunc,
 	}
 }
 
@@ -29,112 +46,242 @@ func (gp *NodePool) LoadNodesFromRedis() error {
 	if gp.redisState == nil {
 		return nil
 	}
-	nodeUris, err := gp.redisState.GetNodes()
+	nodeConfigs, err := gp.redisState.GetNodes()
 	if err != nil {
 		return errors.Wrap(err, "loading nodes from redis failed")
 	}
-	gp.log.Infow("NodePool: loaded nodes from redis", "numNodes", len(nodeUris))
+	gp.log.Infow("NodePool: loaded nodes from redis", "numNodes", len(nodeConfigs))
 
 	// Create the nodes now
-	for _, uri := range nodeUris {
-		_, _, err = gp._addNode(uri)
+	for _, config := range nodeConfigs {
+		_, _, _, err = gp._addNode(config, false)
 		if err != nil {
 			return errors.Wrap(err, "adding node from redis failed")
 		}
 	}
+
+	if len(nodeConfigs) > 0 {
+		gp.recordEvent(NodeEventLoad, "", NodeChangeOrigin{Source: NodeChangeSourceRedis}, []NodeConfig{}, nodeConfigs)
+	}
 	return nil
 }
 
 // HasNode returns true if a node with the URI is already in the pool
 func (gp *NodePool) HasNode(uri string) bool {
-	for _, node := range gp.nodes {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	return gp._getNode(uri) != nil
+}
+
+func (gp *NodePool) _getNode(uri string) *Node {
+	if idx := gp._getNodeIndex(uri); idx >= 0 {
+		return gp.nodes[idx]
+	}
+	return nil
+}
+
+// _getNodeIndex returns the position of the node with the given URI in the pool, or -1. Requires the lock.
+func (gp *NodePool) _getNodeIndex(uri string) int {
+	for idx, node := range gp.nodes {
 		if node.URI == uri {
-			return true
+			return idx
 		}
 	}
-	return false
+	return -1
 }
 
 // AddNode adds a node to the pool and starts the workers. If a new node is added, the list of nodes is saved to redis.
+// Nodes which are already in the pool are left as they are (i.e. with their config loaded from redis).
 func (gp *NodePool) AddNode(uri string) error {
-	added, nodeUris, err := gp._addNode(uri)
+	return gp.addNode(NodeConfig{URI: uri}, NodeChangeOrigin{Source: NodeChangeSourceInternal}, false)
+}
+
+// AddNodeWithConfig adds a node to the pool and starts the workers. If the node already exists, its config
+// is updated (and the workers resized if a number of workers is given). On any change, the list of nodes
+// is saved to redis.
+func (gp *NodePool) AddNodeWithConfig(config NodeConfig) error {
+	return gp.AddNodeFrom(config, NodeChangeOrigin{Source: NodeChangeSourceInternal})
+}
+
+// AddNodeFrom is AddNodeWithConfig, and records the change with its origin in the audit trail
+func (gp *NodePool) AddNodeFrom(config NodeConfig, origin NodeChangeOrigin) error {
+	return gp.addNode(config, origin, true)
+}
+
+// addNode adds a node, or updates the config of an existing node if update is true
+func (gp *NodePool) addNode(config NodeConfig, origin NodeChangeOrigin, update bool) error {
+	prevConfigs, nodeConfigs, added, err := gp._addNode(config, update)
 	if err != nil {
 		return errors.Wrap(err, "AddNode failed")
 	}
 
-	if added {
-		err = gp._saveNodeListToRedis(nodeUris)
+	if nodeConfigs != nil {
+		action := NodeEventUpdate
+		if added {
+			action = NodeEventAdd
+		}
+		gp.recordEvent(action, config.URI, origin, prevConfigs, nodeConfigs)
+
+		err = gp._saveNodeListToRedis(nodeConfigs)
 		if err != nil {
-			gp.log.Errorw("NodePool AddNode: added but failed saving to redis", "URI", uri, "error", err)
+			gp.log.Errorw("NodePool AddNode: added but failed saving to redis", "URI", config.URI, "error", err)
 		} else {
-			gp.log.Debugw("NodePool AddNode: added and saved to redis", "URI", uri, "numNodes", len(gp.nodes))
+			gp.log.Debugw("NodePool AddNode: added and saved to redis", "URI", config.URI, "numNodes", len(gp.nodes))
 		}
 	}
 
 	return err
 }
 
-// _addNode adds a node to the pool and starts the workers. If a new node is added, it also returns nodeUris to be saved to redis.
-func (gp *NodePool) _addNode(uri string) (added bool, nodeUris []string, err error) {
+// _addNode adds a node to the pool and starts the workers, or updates the config of an existing node (if update
+// is true). If anything changed, it returns the node configs before and after the change (to be saved to redis).
+func (gp *NodePool) _addNode(config NodeConfig, update bool) (prevConfigs, nodeConfigs []NodeConfig, added bool, err error) {
 	gp.nodesLock.Lock()
-	defer gp.nodesLock.Unlock()
-
-	if gp.HasNode(uri) {
-		return false, nil, nil
+	if node := gp._getNode(config.URI); node != nil {
+		defer gp.nodesLock.Unlock()
+		prevConfigs, nodeConfigs = gp._updateNode(node, config, update)
+		return prevConfigs, nodeConfigs, false, nil
 	}
+	gp.nodesLock.Unlock()
 
-	node, err := NewNode(gp.log, uri, gp.JobC, gp.numWorkersPerNode)
+	// Create and health check the node without the lock, which would block dispatching meanwhile
+	node, err := NewNode(gp.log, config.URI, gp.numWorkersPerNode)
 	if err != nil {
-		return false, nil, err
+		return nil, nil, false, err
 	}
+	if config.Workers > 0 {
+		node.numWorkers = config.Workers
+		node.concurrencyLimiter = newNodeConcurrencyLimiter(config.Workers)
+	}
+	node.SetConfig(config)
+	node.poolNotifyC = gp.notifyC
 
 	err = node.HealthCheck()
 	if err != nil {
-		return false, nil, errors.Wrap(err, "_addNode healthcheck failed")
+		return nil, nil, false, errors.Wrap(err, "_addNode healthcheck failed")
+	}
+
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	// The node may have been added by another caller meanwhile
+	if existingNode := gp._getNode(config.URI); existingNode != nil {
+		prevConfigs, nodeConfigs = gp._updateNode(existingNode, config, update)
+		return prevConfigs, nodeConfigs, false, nil
 	}
 
 	// Add now
+	prevConfigs = gp._nodeConfigs()
 	gp.nodes = append(gp.nodes, node)
-	nodeUris = []string{}
-	for _, node := range gp.nodes {
-		nodeUris = append(nodeUris, node.URI)
-	}
 
 	// Start node workers
 	node.StartWorkers()
-	gp.log.Infow("NodePool: added node", "URI", uri, "numNodes", len(gp.nodes))
-	return true, nodeUris, nil
+	gp.log.Infow("NodePool: added node", "URI", config.URI, "numNodes", len(gp.nodes))
+	return prevConfigs, gp._nodeConfigs(), true, nil
 }
 
-func (gp *NodePool) _saveNodeListToRedis(nodeUris []string) error {
+// _updateNode applies the config to an existing node if update is true. If it changed, it returns the node
+// configs before and after the change. Requires the lock.
+func (gp *NodePool) _updateNode(node *Node, config NodeConfig, update bool) (prevConfigs, nodeConfigs []NodeConfig) {
+	if !update {
+		return nil, nil
+	}
+	prevConfig := node.Config()
+	if config.Workers == 0 {
+		config.Workers = prevConfig.Workers
+	}
+	if reflect.DeepEqual(prevConfig, config) {
+		return nil, nil
+	}
+
+	prevConfigs = gp._nodeConfigs()
+	node.SetConfig(config)
+	if config.Workers > 0 {
+		node.SetNumWorkers(config.Workers)
+	}
+	gp.log.Infow("NodePool: updated node config", "URI", config.URI)
+	return prevConfigs, gp._nodeConfigs()
+}
+
+func (gp *NodePool) _nodeConfigs() []NodeConfig {
+	nodeConfigs := []NodeConfig{}
+	for _, node := range gp.nodes {
+		nodeConfigs = append(nodeConfigs, node.Config())
+	}
+	return nodeConfigs
+}
+
+func (gp *NodePool) _saveNodeListToRedis(nodeConfigs []NodeConfig) error {
 	if gp.redisState == nil {
 		return nil
 	}
 
-	return gp.redisState.SaveNodes(nodeUris)
+	return gp.redisState.SaveNodes(nodeConfigs)
 }
 
 func (gp *NodePool) DelNode(uri string) (deleted bool, err error) {
-	for idx, node := range gp.nodes {
-		if node.URI == uri {
-			node.StopWorkers()
+	return gp.DelNodeFrom(uri, NodeChangeOrigin{Source: NodeChangeSourceInternal})
+}
 
-			gp.nodesLock.Lock()
-			defer gp.nodesLock.Unlock()
+// DelNodeFrom is DelNode, and records the change with its origin in the audit trail
+func (gp *NodePool) DelNodeFrom(uri string, origin NodeChangeOrigin) (deleted bool, err error) {
+	// Remove node, and let a dispatch waiting for this node select another one
+	gp.nodesLock.Lock()
+	idx := gp._getNodeIndex(uri)
+	if idx < 0 {
+		gp.nodesLock.Unlock()
+		return false, nil
+	}
+	node := gp.nodes[idx]
+	prevConfigs := gp._nodeConfigs()
+	gp.nodes = append(gp.nodes[:idx], gp.nodes[idx+1:]...)
+	if balancer, ok := gp.balancer.(nodeStateBalancer); ok {
+		balancer.RemoveNode(uri)
+	}
+	node.notifyPool()
+	nodeConfigs := gp._nodeConfigs()
+	gp.nodesLock.Unlock()
 
-			// Remove node
-			gp.nodes = append(gp.nodes[:idx], gp.nodes[idx+1:]...)
+	// Stop the workers, record the change and save new list of nodes to redis (without the lock, to not block dispatching)
+	node.StopWorkers()
+	deleteNodeMetrics(uri)
+	gp.recordEvent(NodeEventRemove, uri, origin, prevConfigs, nodeConfigs)
+	err = gp._saveNodeListToRedis(nodeConfigs)
+	return true, err
+}
 
-			// Save new list of nodes to redis
-			nodeUris := []string{}
-			for _, node := range gp.nodes {
-				nodeUris = append(nodeUris, node.URI)
-			}
-			err = gp._saveNodeListToRedis(nodeUris)
-			return true, err
-		}
+// recordEvent appends a node pool change to the audit trail in redis. Failures are only logged.
+func (gp *NodePool) recordEvent(action, uri string, origin NodeChangeOrigin, before, after []NodeConfig) {
+	if gp.redisState == nil {
+		return
+	}
+
+	if origin.Actor == "" {
+		origin.Actor = "system"
+	}
+	instance, _ := os.Hostname()
+	event := NodeEvent{
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		URI:       uri,
+		Actor:     origin.Actor,
+		Source:    origin.Source,
+		Instance:  instance,
+		Before:    before,
+		After:     after,
+	}
+	if err := gp.redisState.AddNodeEvent(event); err != nil {
+		gp.log.Errorw("NodePool: failed saving node event to redis", "action", action, "URI", uri, "error", err)
+	}
+}
+
+// NodeEvents returns up to count node pool changes older than the event with the given ID (or the newest
+// changes if before is empty), newest first
+func (gp *NodePool) NodeEvents(before string, count int64) ([]NodeEvent, error) {
+	if gp.redisState == nil {
+		return nil, ErrNoNodeEvents
 	}
-	return false, nil
+	return gp.redisState.GetNodeEvents(before, count)
 }
 
 func (gp *NodePool) NodeUris() []string {
@@ -148,8 +295,335 @@ func (gp *NodePool) NodeUris() []string {
 	return nodeUris
 }
 
+// SetBalancer sets the strategy used to select the node for each request
+func (gp *NodePool) SetBalancer(balancer Balancer) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	gp.balancer = balancer
+}
+
+// isEligible returns true if the node may process the request (regardless of its current capacity)
+func isEligible(node *Node, req *SimRequest) bool {
+	return mayProcess(node, req) && node.HasBlock(req.MinBlockNumber)
+}
+
+// mayProcess returns true if the node is available and may process the request (payload size, labels), regardless of its block
+func mayProcess(node *Node, req *SimRequest) bool {
+	return node.IsAvailable() && node.AcceptsPayload(len(req.Payload)) && node.HasLabels(req.NodeLabels)
+}
+
+// selectNode returns the node which should process the request, or nil if no node can take it right now.
+// hasEligible is false if no available node may process the request at all.
+func (gp *NodePool) selectNode(req *SimRequest) (node *Node, hasEligible bool) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	candidates := make([]*Node, 0, len(gp.nodes))
+	for _, node := range gp.nodes {
+		if isEligible(node, req) {
+			hasEligible = true
+			if node.HasCapacity() {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, hasEligible
+	}
+	return gp.balancer.Select(candidates, req), true
+}
+
+// Dispatch hands the request to a worker of the node selected by the balancer. If no node can take
+// the request, it waits until one can, for at most timeout. Returns ErrNodeTimeout on timeout, and
+// ErrNoNodesAvailable if no available node may process the request at all.
+func (gp *NodePool) Dispatch(req *SimRequest, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		node, hasEligible := gp.selectNode(req)
+		if !hasEligible {
+			return ErrNoNodesAvailable
+		}
+		if node == nil {
+			// Wait until a node has free capacity again
+			select {
+			case <-gp.notifyC:
+				continue
+			case <-timer.C:
+				return ErrNodeTimeout
+			}
+		}
+
+		if !node.reserve() {
+			continue
+		}
+
+		// Only an idle worker receives from the node's job channel. If the state of any node changes
+		// while waiting, select again.
+		select {
+		case node.jobC <- req:
+			return nil
+		case <-gp.notifyC:
+			node.release()
+			continue
+		case <-timer.C:
+			node.release()
+			return ErrNodeTimeout
+		}
+	}
+}
+
+// DrainNode stops the node from taking new jobs, and waits in the background for up to timeout until the
+// requests in flight are finished. If remove is true, the node is removed from the pool afterwards (also
+// on timeout). Progress is visible in NodeInfo (draining, inFlight).
+func (gp *NodePool) DrainNode(uri string, timeout time.Duration, remove bool) error {
+	return gp.DrainNodeFrom(uri, timeout, remove, NodeChangeOrigin{Source: NodeChangeSourceInternal})
+}
+
+// DrainNodeFrom is DrainNode, and records the change with its origin in the audit trail
+func (gp *NodePool) DrainNodeFrom(uri string, timeout time.Duration, remove bool, origin NodeChangeOrigin) error {
+	gp.nodesLock.Lock()
+	node := gp._getNode(uri)
+	nodeConfigs := gp._nodeConfigs()
+	gp.nodesLock.Unlock()
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	generation, wait := node.StartDrain(remove)
+	gp.recordEvent(NodeEventDrain, uri, origin, nodeConfigs, nodeConfigs)
+	if !wait {
+		return nil // already draining, and the ongoing wait removes the node if requested now
+	}
+	go gp.finishDrain(node, timeout, generation)
+	return nil
+}
+
+// finishDrain waits until the draining node has no requests in flight, and removes it if requested. Stops if the
+// node was undrained meanwhile (also if it's draining again, with a new generation).
+func (gp *NodePool) finishDrain(node *Node, timeout time.Duration, generation uint64) {
+	log := gp.log.With("URI", node.URI)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	timeStarted := time.Now()
+	lastLogAt := timeStarted
+	for node.NumInFlight() > 0 {
+		if !node.drainOngoing(generation) {
+			break
+		}
+		if time.Since(timeStarted) >= timeout {
+			log.Warnw("NodePool: timeout while draining node", "inFlight", node.NumInFlight(), "timeout", timeout)
+			break
+		}
+		if time.Since(lastLogAt) >= time.Second {
+			log.Infow("NodePool: draining node", "inFlight", node.NumInFlight())
+			lastLogAt = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-gp.cancelContext.Done():
+			node.endDrainWait(generation)
+			return
+		}
+	}
+
+	ongoing, remove := node.endDrainWait(generation)
+	if !ongoing {
+		log.Infow("NodePool: node drain was stopped")
+		return
+	}
+	log.Infow("NodePool: node drained", "inFlight", node.NumInFlight(), "durationMs", time.Since(timeStarted).Milliseconds())
+
+	if remove {
+		if _, err := gp.DelNodeFrom(node.URI, NodeChangeOrigin{Source: NodeChangeSourceDrain}); err != nil {
+			log.Errorw("NodePool: removing drained node failed", "error", err)
+		} else {
+			log.Infow("NodePool: removed drained node", "numNodes", len(gp.NodeUris()))
+		}
+	}
+}
+
+// SetNodeWorkers changes the number of workers of a node at runtime, and saves it to redis
+func (gp *NodePool) SetNodeWorkers(uri string, numWorkers int32) error {
+	return gp.SetNodeWorkersFrom(uri, numWorkers, NodeChangeOrigin{Source: NodeChangeSourceInternal})
+}
+
+// SetNodeWorkersFrom is SetNodeWorkers, and records the change with its origin in the audit trail
+func (gp *NodePool) SetNodeWorkersFrom(uri string, numWorkers int32, origin NodeChangeOrigin) error {
+	if numWorkers <= 0 {
+		return ErrInvalidNumWorkers
+	}
+
+	gp.nodesLock.Lock()
+	node := gp._getNode(uri)
+	if node == nil {
+		gp.nodesLock.Unlock()
+		return ErrNodeNotFound
+	}
+
+	prevConfigs := gp._nodeConfigs()
+	config := node.Config()
+	config.Workers = numWorkers
+	node.SetConfig(config)
+	node.SetNumWorkers(numWorkers)
+	nodeConfigs := gp._nodeConfigs()
+	gp.nodesLock.Unlock()
+
+	gp.recordEvent(NodeEventResize, uri, origin, prevConfigs, nodeConfigs)
+	return gp._saveNodeListToRedis(nodeConfigs)
+}
+
+// UndrainNode lets a draining node take jobs again
+func (gp *NodePool) UndrainNode(uri string) error {
+	return gp.UndrainNodeFrom(uri, NodeChangeOrigin{Source: NodeChangeSourceInternal})
+}
+
+// UndrainNodeFrom is UndrainNode, and records the change with its origin in the audit trail
+func (gp *NodePool) UndrainNodeFrom(uri string, origin NodeChangeOrigin) error {
+	gp.nodesLock.Lock()
+	node := gp._getNode(uri)
+	nodeConfigs := gp._nodeConfigs()
+	gp.nodesLock.Unlock()
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	node.StopDrain()
+	gp.recordEvent(NodeEventUndrain, uri, origin, nodeConfigs, nodeConfigs)
+	return nil
+}
+
+// NodeInfo returns the public state of the node with the given URI
+func (gp *NodePool) NodeInfo(uri string) (info NodeInfo, found bool) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	node := gp._getNode(uri)
+	if node == nil {
+		return info, false
+	}
+	return node.Info(), true
+}
+
+// NodeConfig returns the config of a node
+func (gp *NodePool) NodeConfig(uri string) (config NodeConfig, found bool) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	node := gp._getNode(uri)
+	if node == nil {
+		return config, false
+	}
+	return node.Config(), true
+}
+
+// NodeInfos returns the public state of all nodes
+func (gp *NodePool) NodeInfos() []NodeInfo {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	nodeInfos := []NodeInfo{}
+	for _, node := range gp.nodes {
+		nodeInfos = append(nodeInfos, node.Info())
+	}
+	return nodeInfos
+}
+
+// NumAvailableNodes returns the number of nodes which currently take jobs
+func (gp *NodePool) NumAvailableNodes() int {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	res := 0
+	for _, node := range gp.nodes {
+		if node.IsAvailable() {
+			res += 1
+		}
+	}
+	return res
+}
+
+// StartHeadTracker periodically updates the head of all nodes, and excludes nodes that are syncing or
+// lagging more than MaxBlockLag blocks behind the best head in the pool. Runs until Shutdown is called.
+func (gp *NodePool) StartHeadTracker() {
+	if HeadCheckInterval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(HeadCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				gp.UpdateHeads()
+			case <-gp.cancelContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+// UpdateHeads fetches the head of all nodes concurrently, and updates the block lag of each node
+func (gp *NodePool) UpdateHeads() {
+	gp.nodesLock.Lock()
+	nodes := append([]*Node{}, gp.nodes...)
+	gp.nodesLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			if err := node.UpdateHead(); err != nil {
+				gp.log.Debugw("NodePool: updating node head failed", "URI", node.URI, "error", err)
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	bestHead := uint64(0)
+	for _, node := range nodes {
+		if head := node.blockNumber.Load(); head > bestHead {
+			bestHead = head
+		}
+	}
+
+	gp.bestHead.Store(bestHead)
+	for _, node := range nodes {
+		blockLag := bestHead - node.blockNumber.Load()
+		node.setBlockLag(blockLag, node.syncing.Load() || blockLag > uint64(MaxBlockLag))
+	}
+}
+
+// BestHead returns the highest block number of all nodes, 0 if unknown
+func (gp *NodePool) BestHead() uint64 {
+	return gp.bestHead.Load()
+}
+
+// HasNodeWithBlock returns whether any available node may process the request (labels, payload size), and
+// whether any of those has imported the block required by the request
+func (gp *NodePool) HasNodeWithBlock(req *SimRequest) (hasNode, hasBlock bool) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	for _, node := range gp.nodes {
+		if mayProcess(node, req) {
+			hasNode = true
+			if node.HasBlock(req.MinBlockNumber) {
+				return true, true
+			}
+		}
+	}
+	return hasNode, false
+}
+
 // Shutdown will stop all node workers, but let's them finish the ongoing connections
 func (gp *NodePool) Shutdown() {
+	gp.cancelFunc()
 	for _, node := range gp.nodes {
 		node.StopWorkersAndWait()
 	}
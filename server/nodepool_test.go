@@ -5,9 +5,12 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,6 +43,85 @@ func TestNodePool(t *testing.T) {
 	require.True(t, wasDeleted)
 }
 
+func TestNodePoolEvents(t *testing.T) {
+	resetTestRedis()
+	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	mockNodeServer2 := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+
+	gp := NewNodePool(testLog, redisTestState, 1)
+	require.Nil(t, gp.AddNodeFrom(NodeConfig{URI: mockNodeServer1.URL}, NodeChangeOrigin{Source: NodeChangeSourceCLI}))
+	require.Nil(t, gp.AddNodeFrom(NodeConfig{URI: mockNodeServer2.URL}, NodeChangeOrigin{Actor: "token", Source: NodeChangeSourceAPI}))
+	require.Nil(t, gp.AddNodeFrom(NodeConfig{URI: mockNodeServer2.URL}, NodeChangeOrigin{Source: NodeChangeSourceAPI})) // unchanged, no event
+	require.Nil(t, gp.AddNodeWithConfig(NodeConfig{URI: mockNodeServer2.URL, Notes: "updated"}))
+	_, err := gp.DelNodeFrom(mockNodeServer1.URL, NodeChangeOrigin{Actor: "admin", Source: NodeChangeSourceAPI})
+	require.Nil(t, err, err)
+
+	// Newest first
+	events, err := gp.NodeEvents("", 10)
+	require.Nil(t, err, err)
+	require.Equal(t, 4, len(events))
+
+	require.Equal(t, NodeEventRemove, events[0].Action)
+	require.Equal(t, mockNodeServer1.URL, events[0].URI)
+	require.Equal(t, "admin", events[0].Actor)
+	require.Equal(t, 2, len(events[0].Before))
+	require.Equal(t, []NodeConfig{{URI: mockNodeServer2.URL, Notes: "updated"}}, events[0].After)
+
+	require.Equal(t, NodeEventUpdate, events[1].Action)
+	require.Equal(t, "system", events[1].Actor)
+	require.Equal(t, NodeChangeSourceInternal, events[1].Source)
+
+	require.Equal(t, NodeEventAdd, events[2].Action)
+	require.Equal(t, "token", events[2].Actor)
+	require.Equal(t, NodeChangeSourceAPI, events[2].Source)
+
+	require.Equal(t, NodeEventAdd, events[3].Action)
+	require.Equal(t, NodeChangeSourceCLI, events[3].Source)
+	require.Equal(t, 0, len(events[3].Before))
+	require.Equal(t, 1, len(events[3].After))
+
+	// Paging
+	page, err := gp.NodeEvents(events[1].ID, 2)
+	require.Nil(t, err, err)
+	require.Equal(t, events[2:], page)
+	page, err = gp.NodeEvents(events[2].ID, 2)
+	require.Nil(t, err, err)
+	require.Equal(t, events[3:], page)
+	page, err = gp.NodeEvents(events[3].ID, 2)
+	require.Nil(t, err, err)
+	require.Equal(t, 0, len(page))
+
+	// Loading from redis is recorded too
+	gp2 := NewNodePool(testLog, redisTestState, 1)
+	require.Nil(t, gp2.LoadNodesFromRedis())
+	events, err = gp2.NodeEvents("", 1)
+	require.Nil(t, err, err)
+	require.Equal(t, NodeEventLoad, events[0].Action)
+	require.Equal(t, NodeChangeSourceRedis, events[0].Source)
+
+	// Runtime changes through the admin API are recorded as well
+	origin := NodeChangeOrigin{Actor: "admin", Source: NodeChangeSourceAPI}
+	require.Nil(t, gp.SetNodeWorkersFrom(mockNodeServer2.URL, 3, origin))
+	require.Nil(t, gp.DrainNodeFrom(mockNodeServer2.URL, time.Second, false, origin))
+	require.Nil(t, gp.UndrainNodeFrom(mockNodeServer2.URL, origin))
+	events, err = gp.NodeEvents("", 3)
+	require.Nil(t, err, err)
+	require.Equal(t, []string{NodeEventUndrain, NodeEventDrain, NodeEventResize}, []string{events[0].Action, events[1].Action, events[2].Action})
+	require.Equal(t, "admin", events[2].Actor)
+	require.Equal(t, int32(3), events[2].After[0].Workers)
+
+	// The stream is capped
+	defer func(max int) { NodeEventsMax = max }(NodeEventsMax)
+	NodeEventsMax = 3
+	require.Nil(t, gp.AddNodeWithConfig(NodeConfig{URI: mockNodeServer2.URL, Notes: "capped"}))
+	events, err = gp.NodeEvents("", 10)
+	require.Nil(t, err, err)
+	require.Equal(t, 3, len(events))
+
+	_, err = NewNodePool(testLog, nil, 1).NodeEvents("", 10)
+	require.Equal(t, ErrNoNodeEvents, err)
+}
+
 func TestNodePoolWithoutREDIS(t *testing.T) {
 	mockNodeBackend1 := testutils.NewMockNodeBackend()
 	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(mockNodeBackend1.Handler))
@@ -66,7 +148,8 @@ func TestNodePoolProxy(t *testing.T) {
 
 	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
 
-	gp.JobC <- request
+	err = gp.Dispatch(request, time.Second)
+	require.Nil(t, err, err)
 	res := <-request.ResponseC
 	require.NotNil(t, res)
 	require.Nil(t, res.Error, res.Error)
@@ -86,8 +169,272 @@ func TestNodePoolWithError(t *testing.T) {
 	}
 
 	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
-	gp.JobC <- request
+	err = gp.Dispatch(request, time.Second)
+	require.Nil(t, err, err)
 	res := <-request.ResponseC
 	require.NotNil(t, res)
 	require.NotNil(t, res.Error, res.Error)
 }
+
+func TestNodePoolHeadTracking(t *testing.T) {
+	mockNodeBackend1 := testutils.NewMockNodeBackend()
+	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(mockNodeBackend1.Handler))
+	mockNodeBackend2 := testutils.NewMockNodeBackend()
+	mockNodeServer2 := httptest.NewServer(http.HandlerFunc(mockNodeBackend2.Handler))
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer1.URL))
+	require.Nil(t, gp.AddNode(mockNodeServer2.URL))
+	node1, node2 := gp.nodes[0], gp.nodes[1]
+
+	// Within the allowed lag
+	mockNodeBackend1.BlockNumber = 100
+	mockNodeBackend2.BlockNumber = uint64(100 - MaxBlockLag)
+	gp.UpdateHeads()
+	require.Equal(t, uint64(100), node1.Info().BlockNumber)
+	require.Equal(t, uint64(MaxBlockLag), node2.Info().BlockLag)
+	require.True(t, node2.IsAvailable())
+	require.Equal(t, 2, gp.NumAvailableNodes())
+
+	// Lagging too far behind
+	mockNodeBackend1.BlockNumber = 110
+	gp.UpdateHeads()
+	require.Equal(t, uint64(10+MaxBlockLag), node2.Info().BlockLag)
+	require.False(t, node2.IsAvailable())
+	require.Equal(t, 1, gp.NumAvailableNodes())
+
+	// Caught up, but syncing
+	mockNodeBackend2.BlockNumber = 110
+	mockNodeBackend2.Syncing = true
+	gp.UpdateHeads()
+	require.True(t, node2.Info().Syncing)
+	require.False(t, node2.IsAvailable())
+
+	// Synced
+	mockNodeBackend2.Syncing = false
+	gp.UpdateHeads()
+	require.Equal(t, uint64(0), node2.Info().BlockLag)
+	require.True(t, node2.IsAvailable())
+
+	// A node with the block only counts if it may process the request
+	require.Nil(t, gp.AddNodeWithConfig(NodeConfig{URI: mockNodeServer2.URL, Labels: map[string]string{"archive": "true"}}))
+	mockNodeBackend1.BlockNumber = 110
+	mockNodeBackend2.BlockNumber = 111
+	gp.UpdateHeads()
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	request.MinBlockNumber = 111
+	hasNode, hasBlock := gp.HasNodeWithBlock(request)
+	require.True(t, hasNode && hasBlock)
+	request.NodeLabels = []map[string]string{{"archive": "true"}}
+	request.MinBlockNumber = 112
+	hasNode, hasBlock = gp.HasNodeWithBlock(request)
+	require.True(t, hasNode)
+	require.False(t, hasBlock)
+	request.NodeLabels = []map[string]string{{"archive": "false"}}
+	hasNode, hasBlock = gp.HasNodeWithBlock(request)
+	require.False(t, hasNode || hasBlock)
+}
+
+func TestNodePoolDispatch(t *testing.T) {
+	mockNodeBackend1 := testutils.NewMockNodeBackend()
+	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(mockNodeBackend1.Handler))
+	mockNodeBackend2 := testutils.NewMockNodeBackend()
+	mockNodeServer2 := httptest.NewServer(http.HandlerFunc(mockNodeBackend2.Handler))
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer1.URL))
+	require.Nil(t, gp.AddNode(mockNodeServer2.URL))
+
+	// Both nodes are busy with a slow request
+	release := make(chan bool)
+	slowHandler := func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+		<-release
+		return "slow", nil
+	}
+	mockNodeBackend1.RPCHandlerOverride = slowHandler
+	mockNodeBackend2.RPCHandlerOverride = slowHandler
+
+	request1 := NewSimRequest(context.Background(), "1", []byte(`{"method":"eth_callBundle"}`), true, false)
+	request2 := NewSimRequest(context.Background(), "2", []byte(`{"method":"eth_callBundle"}`), true, false)
+	require.Nil(t, gp.Dispatch(request1, time.Second))
+	require.Nil(t, gp.Dispatch(request2, time.Second))
+	require.Eventually(t, func() bool { return gp.nodes[0].inFlight.Load() == 1 && gp.nodes[1].inFlight.Load() == 1 }, time.Second, 5*time.Millisecond)
+
+	// No capacity left -> timeout
+	request3 := NewSimRequest(context.Background(), "3", []byte(`{"method":"eth_callBundle"}`), true, false)
+	require.Equal(t, ErrNodeTimeout, gp.Dispatch(request3, 50*time.Millisecond))
+
+	// Dispatch waits until a node has free capacity
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- true
+	}()
+	require.Nil(t, gp.Dispatch(request3, time.Second))
+	close(release)
+	for _, req := range []*SimRequest{request1, request2, request3} {
+		res := <-req.ResponseC
+		require.Nil(t, res.Error, res.Error)
+	}
+}
+
+func TestNodePoolAddSlowNode(t *testing.T) {
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+
+	// The health check of the new node blocks until unblockC is closed
+	unblockC := make(chan struct{})
+	slowNodeBackend := testutils.NewMockNodeBackend()
+	slowNodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-unblockC
+		slowNodeBackend.Handler(w, req)
+	}))
+	addedC := make(chan error)
+	go func() { addedC <- gp.AddNode(slowNodeServer.URL) }()
+
+	// Requests are dispatched to the other node meanwhile
+	time.Sleep(20 * time.Millisecond)
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.Nil(t, gp.Dispatch(request, 100*time.Millisecond))
+	<-request.ResponseC
+
+	close(unblockC)
+	require.Nil(t, <-addedC)
+	require.Equal(t, 2, len(gp.NodeUris()))
+}
+
+func TestNodePoolConcurrentRemove(t *testing.T) {
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	uris := []string{}
+	for i := 0; i < 4; i++ {
+		mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+		require.Nil(t, gp.AddNode(mockNodeServer.URL))
+		uris = append(uris, mockNodeServer.URL)
+	}
+
+	// Each removal takes out its own node, also when running concurrently
+	var wg sync.WaitGroup
+	for _, uri := range uris[:3] {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			deleted, err := gp.DelNode(uri)
+			assert.Nil(t, err, err)
+			assert.True(t, deleted)
+		}(uri)
+	}
+	wg.Wait()
+	require.Equal(t, uris[3:], gp.NodeUris())
+}
+
+func TestNodePoolNodeConfig(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNodeWithConfig(NodeConfig{URI: mockNodeServer.URL, Workers: 2, Weight: 7, MaxPayloadSize: 10}))
+	node := gp.nodes[0]
+	require.Equal(t, int32(2), node.numWorkers)
+	require.Equal(t, 7, node.Weight())
+
+	// Payloads larger than maxPayloadSize are not sent to the node
+	request := NewSimRequest(context.Background(), "1", []byte("this payload is too large"), true, false)
+	require.Equal(t, ErrNoNodesAvailable, gp.Dispatch(request, 50*time.Millisecond))
+	request = NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.Nil(t, gp.Dispatch(request, time.Second))
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+
+	// Requests restricted to node labels are only sent to matching nodes
+	require.Nil(t, gp.AddNodeWithConfig(NodeConfig{URI: mockNodeServer.URL, Labels: map[string]string{"region": "eu"}}))
+	request = NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	request.NodeLabels = []map[string]string{{"region": "us"}}
+	require.Equal(t, ErrNoNodesAvailable, gp.Dispatch(request, 50*time.Millisecond))
+	request.NodeLabels = []map[string]string{{"region": "us"}, {"region": "eu"}}
+	require.Nil(t, gp.Dispatch(request, time.Second))
+	res = <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+
+	// Adding an existing node by URI (i.e. from the CLI flags) keeps its config
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	require.Equal(t, map[string]string{"region": "eu"}, node.Config().Labels)
+}
+
+func TestNodePoolDrain(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	require.Equal(t, ErrNodeNotFound, gp.DrainNode("http://foo", time.Second, false))
+
+	// Block the backend until unblockC is closed
+	unblockC := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		<-unblockC
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+	}
+
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.Nil(t, gp.Dispatch(request, time.Second))
+	node := gp.nodes[0]
+	require.Eventually(t, func() bool { return node.NumInFlight() == 1 }, time.Second, 5*time.Millisecond)
+
+	// Draining node doesn't take new jobs, but finishes the request in flight
+	require.Nil(t, gp.DrainNode(mockNodeServer.URL, time.Second, true))
+	info, found := gp.NodeInfo(mockNodeServer.URL)
+	require.True(t, found)
+	require.True(t, info.Draining)
+	require.Equal(t, int32(1), info.InFlight)
+	request2 := NewSimRequest(context.Background(), "2", []byte("foo"), true, false)
+	require.Equal(t, ErrNoNodesAvailable, gp.Dispatch(request2, 50*time.Millisecond))
+	require.True(t, gp.HasNode(mockNodeServer.URL))
+
+	close(unblockC)
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+
+	// Removed once drained
+	require.Eventually(t, func() bool { return !gp.HasNode(mockNodeServer.URL) }, time.Second, 5*time.Millisecond)
+}
+
+func TestNodePoolDrainRestarted(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+
+	unblockC := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		<-unblockC
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+	}
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	require.Nil(t, gp.Dispatch(request, time.Second))
+	node := gp.nodes[0]
+	require.Eventually(t, func() bool { return node.NumInFlight() == 1 }, time.Second, 5*time.Millisecond)
+
+	// The first drain was stopped, so only the second one (without remove) applies
+	require.Nil(t, gp.DrainNode(mockNodeServer.URL, time.Second, true))
+	require.Nil(t, gp.UndrainNode(mockNodeServer.URL))
+	require.Nil(t, gp.DrainNode(mockNodeServer.URL, time.Second, false))
+
+	close(unblockC)
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	time.Sleep(5 * drainCheckInterval)
+	require.True(t, gp.HasNode(mockNodeServer.URL))
+	require.True(t, node.IsDraining())
+
+	// Asking for removal while already draining removes the node once drained
+	require.Nil(t, gp.DrainNode(mockNodeServer.URL, time.Second, true))
+	require.Eventually(t, func() bool { return !gp.HasNode(mockNodeServer.URL) }, time.Second, 5*time.Millisecond)
+}
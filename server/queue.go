@@ -1,70 +1,415 @@
 package server
 
 import (
+	"container/heap"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/atomic"
 )
 
-// PrioQueue has 3 queues: fastTrack, highPrio and lowPrio
-// - items will be popped 1:1 from fastTrack and highPrio, until both are empty
-// - then items from lowPrio queue are used
+// QueueClass configures one priority class of the PrioQueue
+type QueueClass struct {
+	Name           string `json:"name"`
+	Weight         int    `json:"weight,omitempty"`         // share of dispatches relative to the other weighted classes. 0 means only when all weighted classes are empty.
+	MaxItems       int    `json:"maxItems,omitempty"`       // max items in the queue of this class. 0 means no limit.
+	StrictPriority bool   `json:"strictPriority,omitempty"` // strict-priority classes are drained before all other classes
+
+	// Requests waiting longer than this are promoted and served before all other classes, so that the class
+	// can't starve. Promotions are limited to every agingPromotionInterval-th item, so that they can't starve
+	// the other classes in turn. 0 disables aging.
+	AgingThresholdMs int `json:"agingThresholdMs,omitempty"`
+
+	// With fair queuing, the requests of each client (see SimRequest.ClientID) are queued separately, and the
+	// clients take turns. MaxItemsPerClient limits the queued requests of a client, 0 means no limit.
+	FairQueuing       bool `json:"fairQueuing,omitempty"`
+	MaxItemsPerClient int  `json:"maxItemsPerClient,omitempty"`
+}
+
+// DefaultQueueClasses returns the default profile with fast-track, high-prio and low-prio classes:
+// - fast-track and high-prio are popped numFastTrackForHighPrio:1, until both are empty (fast-track first if fastTrackDrainFirst)
+// - then items from the low-prio queue are used, or earlier once they waited longer than lowPrioAgingThresholdMs
+// - with FairQueuing, the clients take turns within each class
+func DefaultQueueClasses(maxFastTrack, maxHighPrio, maxLowPrio, numFastTrackForHighPrio int, fastTrackDrainFirst bool, lowPrioAgingThresholdMs int) []QueueClass {
+	classes := []QueueClass{
+		{Name: QueueNameFastTrack, Weight: numFastTrackForHighPrio, MaxItems: maxFastTrack, StrictPriority: fastTrackDrainFirst},
+		{Name: QueueNameHighPrio, Weight: 1, MaxItems: maxHighPrio},
+		{Name: QueueNameLowPrio, MaxItems: maxLowPrio, AgingThresholdMs: lowPrioAgingThresholdMs},
+	}
+	for i := range classes {
+		classes[i].FairQueuing = FairQueuing
+		classes[i].MaxItemsPerClient = MaxQueueItemsPerClient
+	}
+	return classes
+}
+
+// LoadQueueClasses reads the queue classes from a JSON file
+func LoadQueueClasses(filename string) ([]QueueClass, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading queue classes failed")
+	}
+
+	classes := []QueueClass{}
+	if err = json.Unmarshal(data, &classes); err != nil {
+		return nil, errors.Wrap(err, "parsing queue classes failed")
+	}
+	return classes, validateQueueClasses(classes)
+}
+
+func validateQueueClasses(classes []QueueClass) error {
+	if len(classes) == 0 {
+		return errors.New("no queue classes configured")
+	}
+
+	names := make(map[string]bool)
+	for i, class := range classes {
+		if class.Name == "" {
+			return errors.Errorf("queue class %d has no name", i)
+		} else if names[class.Name] {
+			return errors.Errorf("duplicate queue class: %s", class.Name)
+		} else if class.Weight < 0 || class.MaxItems < 0 || class.AgingThresholdMs < 0 || class.MaxItemsPerClient < 0 {
+			return errors.Errorf("queue class %s has a negative weight, maxItems, agingThresholdMs or maxItemsPerClient", class.Name)
+		} else if class.MaxItemsPerClient > 0 && !class.FairQueuing {
+			return errors.Errorf("queue class %s has maxItemsPerClient without fairQueuing", class.Name)
+		}
+		names[class.Name] = true
+	}
+	return nil
+}
+
+// requestHeap orders requests by deadline, and requests with the same deadline in order of arrival (see container/heap)
+type requestHeap []*SimRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].queueDeadline.Equal(h[j].queueDeadline) {
+		return h[i].queueSeq < h[j].queueSeq
+	}
+	return h[i].queueDeadline.Before(h[j].queueDeadline)
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].queueIndex = i
+	h[j].queueIndex = j
+}
+
+func (h *requestHeap) Push(x any) {
+	r := x.(*SimRequest)
+	r.queueIndex = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *requestHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.queueIndex = -1
+	*h = old[:len(old)-1]
+	return r
+}
+
+// ageHeap orders requests by creation time, to find the oldest request of a class for aging (see container/heap)
+type ageHeap []*SimRequest
+
+func (h ageHeap) Len() int { return len(h) }
+
+func (h ageHeap) Less(i, j int) bool {
+	if h[i].CreatedAt.Equal(h[j].CreatedAt) {
+		return h[i].queueSeq < h[j].queueSeq
+	}
+	return h[i].CreatedAt.Before(h[j].CreatedAt)
+}
+
+func (h ageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ageIndex = i
+	h[j].ageIndex = j
+}
+
+func (h *ageHeap) Push(x any) {
+	r := x.(*SimRequest)
+	r.ageIndex = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *ageHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.ageIndex = -1
+	*h = old[:len(old)-1]
+	return r
+}
+
+type queueClass struct {
+	QueueClass
+	clients    map[string]*requestHeap // queued items by client ID (all in one heap without fair queuing)
+	byAge      ageHeap                 // all queued items by creation time, only with an aging threshold
+	clientRing []string                // clients with queued items, in round robin order
+	nextClient int                     // index in clientRing of the client to pop from next
+	numItems   int
+	deficit    int // remaining dispatches in the current round (deficit round robin)
+	index      int // position in the configured classes, 0 is the highest priority
+}
+
+func newQueueClass(config QueueClass) *queueClass {
+	return &queueClass{
+		QueueClass: config,
+		clients:    make(map[string]*requestHeap),
+	}
+}
+
+// clientKey returns the client sub-queue of a request: its client ID with fair queuing, else a single one for all clients
+func (c *queueClass) clientKey(r *SimRequest) string {
+	if c.FairQueuing {
+		return r.ClientID
+	}
+	return ""
+}
+
+// isFull returns true if the class, or the sub-queue of the client with fair queuing, has reached its max items
+func (c *queueClass) isFull(r *SimRequest) bool {
+	if c.MaxItems > 0 && c.numItems >= c.MaxItems {
+		return true
+	}
+	if items, found := c.clients[c.clientKey(r)]; found && c.MaxItemsPerClient > 0 {
+		return items.Len() >= c.MaxItemsPerClient
+	}
+	return false
+}
+
+func (c *queueClass) push(r *SimRequest) {
+	key := c.clientKey(r)
+	items, found := c.clients[key]
+	if !found {
+		items = &requestHeap{}
+		c.clients[key] = items
+		c.clientRing = append(c.clientRing, key)
+	}
+	heap.Push(items, r)
+	if c.AgingThresholdMs > 0 {
+		heap.Push(&c.byAge, r)
+	}
+	c.numItems += 1
+}
+
+// oldest returns the item with the earliest creation time, or nil if the class is empty or has no aging threshold
+func (c *queueClass) oldest() *SimRequest {
+	if len(c.byAge) == 0 {
+		return nil
+	}
+	return c.byAge[0]
+}
+
+// popOldest takes the item with the earliest creation time, for promotion of aged requests
+func (c *queueClass) popOldest() *SimRequest {
+	r := c.oldest()
+	c.remove(r)
+	return r
+}
+
+// pop takes the item with the earliest deadline of the next client, and moves on to the next client (round robin)
+func (c *queueClass) pop() *SimRequest {
+	key := c.clientRing[c.nextClient]
+	items := c.clients[key]
+	r := heap.Pop(items).(*SimRequest)
+	if r.ageIndex >= 0 {
+		heap.Remove(&c.byAge, r.ageIndex)
+	}
+	c.numItems -= 1
+	if items.Len() == 0 {
+		c.removeClient(c.nextClient)
+	} else {
+		c.nextClient = (c.nextClient + 1) % len(c.clientRing)
+	}
+	return r
+}
+
+// remove takes an item out of the class, returns false if it's not queued in the class
+func (c *queueClass) remove(r *SimRequest) bool {
+	key := c.clientKey(r)
+	items, found := c.clients[key]
+	if !found || r.queueIndex < 0 || r.queueIndex >= items.Len() || (*items)[r.queueIndex] != r {
+		return false
+	}
+	heap.Remove(items, r.queueIndex)
+	if r.ageIndex >= 0 {
+		heap.Remove(&c.byAge, r.ageIndex)
+	}
+	c.numItems -= 1
+	if items.Len() == 0 {
+		for i := range c.clientRing {
+			if c.clientRing[i] == key {
+				c.removeClient(i)
+				break
+			}
+		}
+	}
+	return true
+}
+
+func (c *queueClass) removeClient(i int) {
+	delete(c.clients, c.clientRing[i])
+	c.clientRing = append(c.clientRing[:i], c.clientRing[i+1:]...)
+	if i < c.nextClient {
+		c.nextClient -= 1
+	}
+	if c.nextClient >= len(c.clientRing) {
+		c.nextClient = 0
+	}
+}
+
+// agingPromotionInterval limits promotions to every n-th popped item, so the other classes keep at least (n-1)/n of the dispatches
+const agingPromotionInterval = 4
+
+// PrioQueue has a queue per priority class (see QueueClass). The next item is taken from
+// - the oldest request beyond the aging threshold of its class, if there was no promotion in the last agingPromotionInterval-1 items
+// - else the first non-empty strict-priority class
+// - else the weighted classes, by deficit round robin: each class gets `weight` items per round
+// - else the first non-empty class without weight
 //
-// maybe we should configure that every n-th item is used from low-prio?
+// Within a class, items are ordered by deadline (see SimRequest.SchedulingDeadline). With fair queuing, each client
+// has its own queue in the class, and the clients take turns.
 type PrioQueue struct {
-	fastTrack []*SimRequest
-	highPrio  []*SimRequest
-	lowPrio   []*SimRequest
+	classes  []*queueClass
+	aging    []*queueClass // classes with an aging threshold
+	byName   map[string]*queueClass
+	strict   []*queueClass
+	weighted []*queueClass
+	fallback []*queueClass // classes without weight, only used if all others are empty
 
-	cond       *sync.Cond
-	closed     atomic.Bool
-	nFastTrack atomic.Int32
+	drrIndex       int    // weighted class of the current round robin turn
+	seq            uint64 // number of pushed items, to keep the order of arrival for items with the same deadline
+	sincePromotion int    // number of popped items since the last promotion of an aged request
 
-	maxFastTrack int // max items for fast-track queue. 0 means no limit.
-	maxHighPrio  int // max items for high prio queue. 0 means no limit.
-	maxLowPrio   int // max items for low prio queue. 0 means no limit.
-
-	numFastTrackForHighPrio int
-	fastTrackDrainFirst     bool
+	cond   *sync.Cond
+	closed atomic.Bool
 }
 
+// NewPrioQueue returns a queue with the default fast-track, high-prio and low-prio classes without aging (see DefaultQueueClasses)
 func NewPrioQueue(maxFastTrack, maxHighPrio, maxLowPrio, numFastTrackForHighPrio int, fastTrackDrainFirst bool) *PrioQueue {
-	return &PrioQueue{
-		cond:         sync.NewCond(&sync.Mutex{}),
-		maxFastTrack: maxFastTrack,
-		maxHighPrio:  maxHighPrio,
-		maxLowPrio:   maxLowPrio,
+	q, _ := NewPrioQueueWithClasses(DefaultQueueClasses(maxFastTrack, maxHighPrio, maxLowPrio, numFastTrackForHighPrio, fastTrackDrainFirst, 0))
+	return q
+}
+
+// NewPrioQueueWithClasses returns a queue with the given classes. Their order is the priority order of the
+// strict-priority and unweighted classes, and the round robin order of the weighted classes.
+func NewPrioQueueWithClasses(classes []QueueClass) (*PrioQueue, error) {
+	if err := validateQueueClasses(classes); err != nil {
+		return nil, err
+	}
 
-		numFastTrackForHighPrio: numFastTrackForHighPrio,
-		fastTrackDrainFirst:     fastTrackDrainFirst,
+	q := &PrioQueue{
+		byName:         make(map[string]*queueClass),
+		cond:           sync.NewCond(&sync.Mutex{}),
+		sincePromotion: agingPromotionInterval,
 	}
+	for _, config := range classes {
+		class := newQueueClass(config)
+		class.index = len(q.classes)
+		q.classes = append(q.classes, class)
+		q.byName[class.Name] = class
+		if class.AgingThresholdMs > 0 {
+			q.aging = append(q.aging, class)
+		}
+		if class.StrictPriority {
+			q.strict = append(q.strict, class)
+		} else if class.Weight > 0 {
+			q.weighted = append(q.weighted, class)
+		} else {
+			q.fallback = append(q.fallback, class)
+		}
+	}
+	if len(q.weighted) > 0 {
+		q.weighted[0].deficit = q.weighted[0].Weight
+	}
+	return q, nil
+}
+
+// class returns the class with the given name. Requests for unknown classes go to the last configured class.
+func (q *PrioQueue) class(name string) *queueClass {
+	if class, found := q.byName[name]; found {
+		return class
+	}
+	return q.classes[len(q.classes)-1]
+}
+
+// ClassNames returns the names of the configured classes
+func (q *PrioQueue) ClassNames() []string {
+	names := make([]string, len(q.classes))
+	for i, class := range q.classes {
+		names[i] = class.Name
+	}
+	return names
+}
+
+// ClassIndex returns the position of a class in the configured classes, 0 is the highest priority
+func (q *PrioQueue) ClassIndex(name string) int {
+	return q.class(name).index
+}
+
+// ClassLen returns the number of items in the queue of a class
+func (q *PrioQueue) ClassLen(name string) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.class(name).numItems
 }
 
+// ClassLens returns a snapshot of the number of items in the queue of each class, by class name
+func (q *PrioQueue) ClassLens() map[string]int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	lens := make(map[string]int, len(q.classes))
+	for _, class := range q.classes {
+		lens[class.Name] = class.numItems
+	}
+	return lens
+}
+
+// Len returns the number of items of the default classes, 0 for the ones which are not configured
 func (q *PrioQueue) Len() (lenFastTrack, lenHighPrio, lenLowPrio int) {
-	return len(q.fastTrack), len(q.highPrio), len(q.lowPrio)
+	lens := q.ClassLens()
+	return lens[QueueNameFastTrack], lens[QueueNameHighPrio], lens[QueueNameLowPrio]
 }
 
 func (q *PrioQueue) NumRequests() int {
-	return len(q.fastTrack) + len(q.highPrio) + len(q.lowPrio)
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q._numRequests()
 }
 
-func (q *PrioQueue) String() string {
-	return fmt.Sprintf("PrioQueue: fastTrack: %d / highPrio: %d / lowPrio: %d", len(q.fastTrack), len(q.highPrio), len(q.lowPrio))
+// _numRequests returns the number of items in all classes. Requires the lock.
+func (q *PrioQueue) _numRequests() int {
+	num := 0
+	for _, class := range q.classes {
+		num += class.numItems
+	}
+	return num
 }
 
-// Push adds a new item to the end of the queue. Returns true if added, false if queue is closed or at max capacity
-func (q *PrioQueue) Push(r *SimRequest) bool {
-	if q.closed.Load() || r == nil {
-		return false
+func (q *PrioQueue) String() string {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	sizes := make([]string, len(q.classes))
+	for i, class := range q.classes {
+		sizes[i] = fmt.Sprintf("%s: %d", class.Name, class.numItems)
 	}
+	return "PrioQueue: " + strings.Join(sizes, " / ")
+}
 
-	// If queue limits are set and reached, return false now
-	if r.IsFastTrack && q.maxFastTrack > 0 && len(q.fastTrack) >= q.maxFastTrack {
-		return false
-	} else if r.IsHighPrio && q.maxHighPrio > 0 && len(q.highPrio) >= q.maxHighPrio {
-		return false
-	} else if !r.IsHighPrio && q.maxLowPrio > 0 && len(q.lowPrio) >= q.maxLowPrio {
+// Push adds a new item to the queue of its class, before the items with a later deadline. Returns true if added, false if queue is closed or at max capacity
+func (q *PrioQueue) Push(r *SimRequest) bool {
+	if q.closed.Load() || r == nil || r.IsCancelled() {
 		return false
 	}
 
@@ -72,96 +417,130 @@ func (q *PrioQueue) Push(r *SimRequest) bool {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
-	// Check if closed in the meantime
-	if q.closed.Load() {
+	// Check if closed in the meantime, or if the queue limits are set and reached
+	class := q.class(queueName(r))
+	if q.closed.Load() || class.isFull(r) {
 		return false
 	}
 
-	// Add to the queue
-	if r.IsFastTrack {
-		q.fastTrack = append(q.fastTrack, r)
-	} else if r.IsHighPrio {
-		q.highPrio = append(q.highPrio, r)
-	} else {
-		q.lowPrio = append(q.lowPrio, r)
-	}
+	// Add to the queue, ordered by deadline (requests with the same deadline in order of arrival)
+	q.seq += 1
+	r.queueSeq = q.seq
+	r.queueDeadline = r.SchedulingDeadline()
+	r.queuedAt = time.Now()
+	class.push(r)
 
 	// Unlock and send signal to a listener
 	q.cond.Signal()
 	return true
 }
 
-// Pop returns the next Bid. If no task in queue, blocks until there is one again. First drains the high-prio queue,
-// then the low-prio one. Will return nil only after calling Close() when the queue is empty
+// Pop returns the next Bid. If no task in queue, blocks until there is one again. The class to take it from
+// is chosen by priority and weight (see PrioQueue). Will return nil only after calling Close() when the queue is empty
 func (q *PrioQueue) Pop() (nextReq *SimRequest) {
-	// Return nil immediately if queue is closed and empty
-	if q.closed.Load() && len(q.fastTrack) == 0 && len(q.highPrio) == 0 && len(q.lowPrio) == 0 {
-		return nil
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	// Wait for an item. Check again after waking up, a cancelled request may have been removed meanwhile.
+	for q._numRequests() == 0 && !q.closed.Load() {
+		q.cond.Wait()
+	}
+	if q._numRequests() == 0 {
+		return nil // closed and empty
 	}
 
+	if class, promoted := q.nextClass(); promoted {
+		nextReq = class.popOldest()
+	} else if class != nil {
+		nextReq = class.pop()
+	}
+
+	// When closed and the last item was taken, signal to CloseAndWait that queue is now empty
+	if q.closed.Load() && q._numRequests() == 0 {
+		q.cond.Broadcast()
+	}
+
+	return nextReq
+}
+
+// Remove takes a request out of the queue, i.e. when it was cancelled. Returns false if the request was not queued.
+func (q *PrioQueue) Remove(r *SimRequest) bool {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
-	if len(q.fastTrack) == 0 && len(q.highPrio) == 0 && len(q.lowPrio) == 0 {
-		if q.closed.Load() {
-			return nil
-		}
+	if !q.class(queueName(r)).remove(r) {
+		return false
+	}
 
-		q.cond.Wait()
+	// Signal to CloseAndWait if the queue is now empty
+	if q.closed.Load() && q._numRequests() == 0 {
+		q.cond.Broadcast()
 	}
+	return true
+}
 
-	// decide whether to start with fast-track or high-prio queue
-	processFastTrack := len(q.fastTrack) > 0
-	if !q.fastTrackDrainFirst {
-		if processFastTrack {
-			// only fast-track every so often
-			if q.nFastTrack.Inc() > int32(q.numFastTrackForHighPrio) {
-				q.nFastTrack.Store(0)
-				processFastTrack = false
-			}
-		} else {
-			q.nFastTrack.Store(0)
+// nextClass returns the class to pop the next item from, or nil if all are empty. If promoted is true, the
+// oldest item of the class is due for promotion. Requires the lock.
+func (q *PrioQueue) nextClass() (class *queueClass, promoted bool) {
+	q.sincePromotion += 1
+	if q.sincePromotion >= agingPromotionInterval {
+		if class := q.agedClass(); class != nil {
+			q.sincePromotion = 0
+			metricQueuePromotions.WithLabelValues(class.Name).Inc()
+			return class, true
 		}
 	}
 
-	if processFastTrack { // check fast-track queue first
-		if len(q.fastTrack) > 0 {
-			nextReq = q.fastTrack[0]
-			q.fastTrack = q.fastTrack[1:]
-		} else if len(q.highPrio) > 0 {
-			nextReq = q.highPrio[0]
-			q.highPrio = q.highPrio[1:]
-		} else if len(q.lowPrio) > 0 {
-			nextReq = q.lowPrio[0]
-			q.lowPrio = q.lowPrio[1:]
+	for _, class := range q.strict {
+		if class.numItems > 0 {
+			return class, false
 		}
-	} else { // check high-prio queue first
-		if len(q.highPrio) > 0 {
-			nextReq = q.highPrio[0]
-			q.highPrio = q.highPrio[1:]
-		} else if len(q.fastTrack) > 0 {
-			nextReq = q.fastTrack[0]
-			q.fastTrack = q.fastTrack[1:]
-		} else if len(q.lowPrio) > 0 {
-			nextReq = q.lowPrio[0]
-			q.lowPrio = q.lowPrio[1:]
+	}
+
+	// Deficit round robin: stay with the current class until it used up its weight or is empty, then
+	// move on to the next one. After a full round every non-empty class had its turn.
+	for i := 0; i <= len(q.weighted) && len(q.weighted) > 0; i++ {
+		class := q.weighted[q.drrIndex]
+		if class.numItems > 0 && class.deficit > 0 {
+			class.deficit -= 1
+			return class, false
 		}
+		q.drrIndex = (q.drrIndex + 1) % len(q.weighted)
+		q.weighted[q.drrIndex].deficit = q.weighted[q.drrIndex].Weight
 	}
 
-	// When closed and the last item was taken, signal to CloseAndWait that queue is now empty
-	if q.closed.Load() && len(q.highPrio) == 0 && len(q.lowPrio) == 0 {
-		q.cond.Broadcast()
+	for _, class := range q.fallback {
+		if class.numItems > 0 {
+			return class, false
+		}
 	}
+	return nil, false
+}
 
-	return nextReq
+// agedClass returns the class with the oldest request which waited longer than the aging threshold of its class,
+// or nil if there is none. Requires the lock.
+func (q *PrioQueue) agedClass() (agedClass *queueClass) {
+	var maxWaitTime time.Duration
+	for _, class := range q.aging {
+		oldest := class.oldest()
+		if oldest == nil {
+			continue
+		}
+		waitTime := time.Since(oldest.CreatedAt)
+		if waitTime > time.Duration(class.AgingThresholdMs)*time.Millisecond && waitTime > maxWaitTime {
+			agedClass, maxWaitTime = class, waitTime
+		}
+	}
+	return agedClass
 }
 
 // Close disallows adding any new items with Push(), and lets readers using Pop() return nil if queue is empty
 func (q *PrioQueue) Close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
 	q.closed.Store(true)
-	if q.NumRequests() == 0 {
-		q.cond.Broadcast()
-	}
+	q.cond.Broadcast()
 }
 
 // CloseAndWait closes the queue and waits until the queue is empty
@@ -170,7 +549,7 @@ func (q *PrioQueue) CloseAndWait() {
 
 	// Wait until queue is empty
 	q.cond.L.Lock()
-	if q.NumRequests() > 0 {
+	for q._numRequests() > 0 {
 		q.cond.Wait()
 	}
 	q.cond.L.Unlock()
@@ -4,10 +4,13 @@ package server
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,9 +43,9 @@ func fillQueue(t *testing.T, q *PrioQueue) {
 	q.Push(cloneRequest(taskFastTrack))
 	q.Push(cloneRequest(taskFastTrack)) // 5x fastTrack
 
-	require.Equal(t, 5, len(q.fastTrack))
-	require.Equal(t, 11, len(q.highPrio))
-	require.Equal(t, 1, len(q.lowPrio))
+	require.Equal(t, 5, q.ClassLen(QueueNameFastTrack))
+	require.Equal(t, 11, q.ClassLen(QueueNameHighPrio))
+	require.Equal(t, 1, q.ClassLen(QueueNameLowPrio))
 }
 
 func TestQueueBlockingPop(t *testing.T) {
@@ -76,8 +79,8 @@ func TestQueuePopping(t *testing.T) {
 
 	// last one should be low-prio
 	require.Equal(t, false, q.Pop().IsHighPrio)
-	require.Equal(t, 0, len(q.lowPrio))
-	require.Equal(t, 0, len(q.highPrio))
+	require.Equal(t, 0, q.ClassLen(QueueNameLowPrio))
+	require.Equal(t, 0, q.ClassLen(QueueNameHighPrio))
 
 	// Test 2 - expected: 2x fastTrack -> 1x highPrio
 	q = NewPrioQueue(0, 0, 0, 2, false)
@@ -147,12 +150,289 @@ func TestPrioQueueMultipleReaders(t *testing.T) {
 func TestPrioQueueVarious(t *testing.T) {
 	q := NewPrioQueue(0, 0, 0, 2, false)
 	q.Push(nil)
-	require.Equal(t, 0, len(q.highPrio))
-	require.Equal(t, 0, len(q.lowPrio))
+	require.Equal(t, 0, q.ClassLen(QueueNameHighPrio))
+	require.Equal(t, 0, q.ClassLen(QueueNameLowPrio))
 
 	require.True(t, len(q.String()) > 5)
 }
 
+func TestPrioQueueClasses(t *testing.T) {
+	newRequest := func(class string) *SimRequest {
+		r := NewSimRequest(context.Background(), "1", []byte(class), false, false)
+		r.QueueClass = class
+		return r
+	}
+	popClasses := func(q *PrioQueue, n int) (classes []string) {
+		for i := 0; i < n; i++ {
+			classes = append(classes, q.Pop().QueueClass)
+		}
+		return classes
+	}
+
+	_, err := NewPrioQueueWithClasses([]QueueClass{{Name: "a"}, {Name: "a"}})
+	require.NotNil(t, err)
+	_, err = NewPrioQueueWithClasses([]QueueClass{})
+	require.NotNil(t, err)
+
+	q, err := NewPrioQueueWithClasses([]QueueClass{
+		{Name: "critical", StrictPriority: true},
+		{Name: "a", Weight: 3, MaxItems: 5},
+		{Name: "b", Weight: 1},
+		{Name: "background"},
+	})
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"critical", "a", "b", "background"}, q.ClassNames())
+
+	// Per-class max items
+	for i := 0; i < 5; i++ {
+		require.True(t, q.Push(newRequest("a")))
+		require.True(t, q.Push(newRequest("b")))
+	}
+	require.False(t, q.Push(newRequest("a")))
+	require.True(t, q.Push(newRequest("background")))
+	require.True(t, q.Push(newRequest("critical")))
+	require.Equal(t, 5, q.ClassLen("a"))
+
+	// Strict-priority first, then a and b by weight, then the class without weight
+	require.Equal(t, []string{"critical", "a", "a", "a", "b", "a", "a", "b", "b", "b", "b", "background"}, popClasses(q, 12))
+	require.Equal(t, 0, q.NumRequests())
+
+	// Requests for unknown classes go to the last class
+	require.True(t, q.Push(newRequest("foo")))
+	require.Equal(t, 1, q.ClassLen("background"))
+}
+
+func TestPrioQueueAging(t *testing.T) {
+	q, err := NewPrioQueueWithClasses([]QueueClass{
+		{Name: QueueNameHighPrio, Weight: 1},
+		{Name: QueueNameLowPrio, AgingThresholdMs: 20},
+	})
+	require.Nil(t, err, err)
+	promotions := testutil.ToFloat64(metricQueuePromotions.WithLabelValues(QueueNameLowPrio))
+
+	q.Push(NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false))
+	for i := 0; i < 3; i++ {
+		q.Push(NewSimRequest(context.Background(), "1", []byte("taskHighPrio"), true, false))
+	}
+
+	// Within the threshold, high-prio goes first
+	require.True(t, q.Pop().IsHighPrio)
+
+	// Low-prio request is promoted after waiting longer than the threshold
+	time.Sleep(30 * time.Millisecond)
+	require.False(t, q.Pop().IsHighPrio)
+	require.True(t, q.Pop().IsHighPrio)
+	require.Equal(t, promotions+1, testutil.ToFloat64(metricQueuePromotions.WithLabelValues(QueueNameLowPrio)))
+}
+
+func TestPrioQueueAgingOldest(t *testing.T) {
+	q, err := NewPrioQueueWithClasses([]QueueClass{
+		{Name: QueueNameHighPrio, Weight: 1},
+		{Name: QueueNameLowPrio, AgingThresholdMs: 20},
+	})
+	require.Nil(t, err, err)
+
+	// An old request behind a fresh request with an earlier deadline is still promoted
+	q.Push(NewSimRequest(context.Background(), "old", []byte("taskLowPrio"), false, false))
+	time.Sleep(30 * time.Millisecond)
+	r := NewSimRequest(context.Background(), "new", []byte("taskLowPrio"), false, false)
+	r.Deadline = time.Now().Add(time.Second)
+	q.Push(r)
+	q.Push(NewSimRequest(context.Background(), "1", []byte("taskHighPrio"), true, false))
+
+	require.Equal(t, "old", q.Pop().ID)
+	require.True(t, q.Pop().IsHighPrio)
+	require.Equal(t, "new", q.Pop().ID)
+	require.Equal(t, 0, q.NumRequests())
+}
+
+func TestPrioQueueAgingShare(t *testing.T) {
+	q, err := NewPrioQueueWithClasses([]QueueClass{
+		{Name: QueueNameFastTrack, StrictPriority: true},
+		{Name: QueueNameLowPrio, AgingThresholdMs: 1},
+	})
+	require.Nil(t, err, err)
+
+	for i := 0; i < 4; i++ {
+		q.Push(NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false))
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		q.Push(NewSimRequest(context.Background(), "1", []byte("taskFastTrack"), false, true))
+	}
+
+	// Aged requests are promoted at most every agingPromotionInterval items, so they don't starve strict-priority classes
+	classes := []string{}
+	for i := 0; i < 8; i++ {
+		classes = append(classes, queueName(q.Pop()))
+	}
+	require.Equal(t, []string{QueueNameLowPrio, QueueNameFastTrack, QueueNameFastTrack, QueueNameFastTrack, QueueNameLowPrio, QueueNameFastTrack, QueueNameFastTrack, QueueNameFastTrack}, classes)
+}
+
+func TestPrioQueueDeadline(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false)
+	newRequest := func(id string, deadline time.Duration) *SimRequest {
+		r := NewSimRequest(context.Background(), id, []byte("taskHighPrio"), true, false)
+		if deadline > 0 {
+			r.Deadline = r.CreatedAt.Add(deadline)
+		}
+		return r
+	}
+
+	// Earliest deadline first, requests without deadline (RequestTimeout) last
+	q.Push(newRequest("1", 0))
+	q.Push(newRequest("2", time.Second))
+	q.Push(newRequest("3", 100*time.Millisecond))
+	q.Push(newRequest("4", time.Second))
+	for _, id := range []string{"3", "2", "4", "1"} {
+		require.Equal(t, id, q.Pop().ID)
+	}
+
+	// Deadline can't be met anymore
+	r := newRequest("1", 50*time.Millisecond)
+	require.False(t, r.DeadlineExceeded(0))
+	require.True(t, r.DeadlineExceeded(100*time.Millisecond))
+	r.CreatedAt = r.CreatedAt.Add(-2 * RequestTimeout)
+	require.True(t, r.DeadlineExceeded(0))
+}
+
+func TestPrioQueueRemove(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false)
+	requests := []*SimRequest{}
+	for i := 0; i < 5; i++ {
+		r := NewSimRequest(context.Background(), fmt.Sprint(i), []byte("taskHighPrio"), true, false)
+		requests = append(requests, r)
+		require.True(t, q.Push(r))
+	}
+
+	require.True(t, q.Remove(requests[2]))
+	require.False(t, q.Remove(requests[2]))
+	require.Equal(t, 4, q.ClassLen(QueueNameHighPrio))
+
+	// Cancelled requests can't be pushed again
+	requests[2].Cancel()
+	require.False(t, q.Push(requests[2]))
+	require.NotNil(t, requests[2].Context.Err())
+
+	for _, id := range []string{"0", "1", "3", "4"} {
+		require.Equal(t, id, q.Pop().ID)
+	}
+	require.False(t, q.Remove(requests[0]))
+}
+
+func TestPrioQueueRemoveWhilePopping(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false)
+	popC := make(chan *SimRequest, 10)
+	go func() {
+		for r := q.Pop(); r != nil; r = q.Pop() {
+			popC <- r
+		}
+		close(popC)
+	}()
+
+	// A request removed before the waiting Pop wakes up doesn't make it return nil while the queue is open
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+		r := NewSimRequest(context.Background(), fmt.Sprint(i), []byte("taskHighPrio"), true, false)
+		require.True(t, q.Push(r))
+		q.Remove(r)
+	}
+	r := NewSimRequest(context.Background(), "last", []byte("taskHighPrio"), true, false)
+	require.True(t, q.Push(r))
+
+	// Some removes may have been too late, but the last request must be popped
+	var popped *SimRequest
+	for popped != r {
+		select {
+		case popped = <-popC:
+			require.NotNil(t, popped, "Pop returned nil while the queue is open")
+		case <-time.After(time.Second):
+			require.Fail(t, "last request was not popped")
+		}
+	}
+
+	q.Close()
+	_, ok := <-popC
+	require.False(t, ok)
+}
+
+// The lengths may be read while requests are pushed and removed, i.e. by the metrics and the tests (run with -race)
+func TestPrioQueueConcurrentLen(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r := NewSimRequest(context.Background(), fmt.Sprint(i), []byte("taskHighPrio"), j%2 == 0, false)
+				q.Push(r)
+				q.Remove(r)
+			}
+		}(i)
+	}
+
+	doneC := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(doneC)
+	}()
+	for {
+		select {
+		case <-doneC:
+			require.Equal(t, 0, q.NumRequests())
+			return
+		default:
+			require.LessOrEqual(t, q.NumRequests(), 4)
+			_, lenHighPrio, lenLowPrio := q.Len()
+			require.LessOrEqual(t, lenHighPrio+lenLowPrio, 4)
+		}
+	}
+}
+
+func TestPrioQueueFairQueuing(t *testing.T) {
+	q, err := NewPrioQueueWithClasses([]QueueClass{{Name: QueueNameHighPrio, Weight: 1, FairQueuing: true, MaxItemsPerClient: 3}})
+	require.Nil(t, err, err)
+	newRequest := func(clientID string) *SimRequest {
+		r := NewSimRequest(context.Background(), clientID, []byte("taskHighPrio"), true, false)
+		r.ClientID = clientID
+		return r
+	}
+
+	// Noisy client a is limited to 3 queued requests
+	for i := 0; i < 3; i++ {
+		require.True(t, q.Push(newRequest("a")))
+	}
+	require.False(t, q.Push(newRequest("a")))
+	require.True(t, q.Push(newRequest("b")))
+	cancelled := newRequest("c")
+	require.True(t, q.Push(cancelled))
+	require.True(t, q.Push(newRequest("c")))
+	require.True(t, q.Remove(cancelled))
+
+	// Clients take turns
+	for _, id := range []string{"a", "b", "c", "a", "a"} {
+		require.Equal(t, id, q.Pop().ID)
+	}
+	require.Equal(t, 0, q.NumRequests())
+
+	// maxItemsPerClient needs fair queuing
+	_, err = NewPrioQueueWithClasses([]QueueClass{{Name: QueueNameHighPrio, MaxItemsPerClient: 3}})
+	require.NotNil(t, err)
+}
+
+func TestLoadQueueClasses(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "classes.json")
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"a","weight":2,"maxItems":10},{"name":"b","weight":1}]`), 0o600))
+	classes, err := LoadQueueClasses(fn)
+	require.Nil(t, err, err)
+	require.Equal(t, []QueueClass{{Name: "a", Weight: 2, MaxItems: 10}, {Name: "b", Weight: 1}}, classes)
+
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"a","weight":-1}]`), 0o600))
+	_, err = LoadQueueClasses(fn)
+	require.NotNil(t, err)
+}
+
 // Test used for benchmark: single reader
 func _testPrioQueue1(numWorkers, numItems int) *PrioQueue {
 	q := NewPrioQueue(0, 0, 0, 2, false)
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	rateLimiterIdleTimeout      = time.Minute           // how long the local token bucket of a client is kept after its last request
+	rateLimiterRedisTimeout     = 50 * time.Millisecond // max time for taking a token from Redis, before using the local token bucket
+	rateLimiterErrorLogInterval = 10 * time.Second      // Redis errors are logged at most once per interval
+)
+
+// redisTokenBucketScript takes a token from the bucket in KEYS[1] (ARGV: rate, burst, current time in seconds).
+// Returns 1 if a token was taken, 0 if the bucket is empty.
+var redisTokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// ClientRateLimiter limits the requests per second of each client, with a limit per queue class. With Redis,
+// the token buckets are shared by all balancer instances, otherwise each instance has its own.
+type ClientRateLimiter struct {
+	log        *zap.SugaredLogger
+	limits     map[string]float64 // requests per second per client, by queue class
+	redisState *RedisState
+
+	lock         sync.Mutex
+	buckets      map[string]*tokenBucket // local token buckets, by queue class and client
+	lastCleanup  time.Time
+	lastErrorLog time.Time
+}
+
+// NewClientRateLimiter returns a rate limiter, or nil if there are no limits
+func NewClientRateLimiter(log *zap.SugaredLogger, limits map[string]float64, redisState *RedisState) *ClientRateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &ClientRateLimiter{
+		log:         log,
+		limits:      limits,
+		redisState:  redisState,
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// ParseRateLimits parses a comma-separated list of queue class and requests per second, i.e. `high-prio:50,low-prio:10`
+func ParseRateLimits(s string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+	for _, limit := range strings.Split(s, ",") {
+		if limit = strings.TrimSpace(limit); limit == "" {
+			continue
+		}
+		queue, rate, found := strings.Cut(limit, ":")
+		ratePerSec, err := strconv.ParseFloat(rate, 64)
+		if !found || err != nil || ratePerSec <= 0 {
+			return nil, errors.Errorf("invalid rate limit: %s", limit)
+		}
+		limits[queue] = ratePerSec
+	}
+	return limits, nil
+}
+
+// Allow takes a token from the bucket of the client for the queue class, and returns false if there is none left.
+// If Redis fails or is too slow, the local token bucket is used.
+func (l *ClientRateLimiter) Allow(clientID, queue string) bool {
+	if l == nil {
+		return true
+	}
+	rate, found := l.limits[queue]
+	if !found {
+		return true
+	}
+	burst := math.Max(1, rate)
+
+	if l.redisState != nil {
+		allowed, err := l.allowRedis(clientID, queue, rate, burst)
+		if err == nil {
+			return allowed
+		}
+		l.logRedisError(err)
+	}
+	return l.allowLocal(clientID, queue, rate, burst)
+}
+
+// allowRedis takes a token from the bucket in Redis, which is shared by all instances. The client ID is
+// hashed in the key, as it's client-provided with a trusted proxy (see ClientIDHeader).
+func (l *ClientRateLimiter) allowRedis(clientID, queue string, rate, burst float64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rateLimiterRedisTimeout)
+	defer cancel()
+
+	clientHash := sha256.Sum256([]byte(clientID))
+	key := fmt.Sprintf("%s%s:%s", RedisKeyRateLimitPrefix, queue, hex.EncodeToString(clientHash[:16]))
+	now := float64(time.Now().UnixMicro()) / 1e6
+	allowed, err := redisTokenBucketScript.Run(ctx, l.redisState.RedisClient, []string{key}, rate, burst, now).Int()
+	return allowed == 1, err
+}
+
+func (l *ClientRateLimiter) logRedisError(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if time.Since(l.lastErrorLog) < rateLimiterErrorLogInterval {
+		return
+	}
+	l.log.Warnw("rate limiter redis error, using local token buckets", "error", err)
+	l.lastErrorLog = time.Now()
+}
+
+// allowLocal takes a token from the bucket of this instance
+func (l *ClientRateLimiter) allowLocal(clientID, queue string, rate, burst float64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cleanup()
+	key := queue + ":" + clientID
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = newTokenBucket(rate, burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.Allow()
+}
+
+// cleanup removes the local token buckets of idle clients. Requires the lock.
+func (l *ClientRateLimiter) cleanup() {
+	if time.Since(l.lastCleanup) < rateLimiterIdleTimeout {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if bucket.idleSince() > rateLimiterIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = time.Now()
+}
+
+// tokenBucket allows on average rate requests per second, with bursts of up to burst requests
+type tokenBucket struct {
+	lock sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket, and returns false if there is none left
+func (b *tokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+func (b *tokenBucket) idleSince() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return time.Since(b.last)
+}
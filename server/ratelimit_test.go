@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(limits))
+
+	limits, err = ParseRateLimits("fast-track:10, low-prio:0.5")
+	require.Nil(t, err)
+	require.Equal(t, map[string]float64{"fast-track": 10, "low-prio": 0.5}, limits)
+
+	_, err = ParseRateLimits("fast-track")
+	require.NotNil(t, err)
+	_, err = ParseRateLimits("fast-track:abc")
+	require.NotNil(t, err)
+	_, err = ParseRateLimits("fast-track:0")
+	require.NotNil(t, err)
+}
+
+func TestClientRateLimiter(t *testing.T) {
+	require.Nil(t, NewClientRateLimiter(testLog, nil, nil))
+	var limiter *ClientRateLimiter
+	require.True(t, limiter.Allow("client1", QueueNameFastTrack))
+
+	resetTestRedis()
+	for _, redisState := range []*RedisState{nil, redisTestState} {
+		limiter = NewClientRateLimiter(testLog, map[string]float64{QueueNameFastTrack: 2}, redisState)
+
+		// burst of 2 requests per client and class
+		require.True(t, limiter.Allow("client1", QueueNameFastTrack))
+		require.True(t, limiter.Allow("client1", QueueNameFastTrack))
+		require.False(t, limiter.Allow("client1", QueueNameFastTrack))
+		require.True(t, limiter.Allow("client2", QueueNameFastTrack))
+
+		// classes without a limit
+		require.True(t, limiter.Allow("client1", QueueNameLowPrio))
+	}
+
+	// the buckets in Redis are shared between instances
+	limiter2 := NewClientRateLimiter(testLog, map[string]float64{QueueNameFastTrack: 2}, redisTestState)
+	require.False(t, limiter2.Allow("client1", QueueNameFastTrack))
+	require.True(t, limiter2.Allow("client3", QueueNameFastTrack))
+
+	// the client IDs are hashed in the Redis keys
+	for _, key := range redisTestServer.Keys() {
+		require.False(t, strings.Contains(key, "client"), key)
+	}
+
+	// without Redis, the local buckets are used
+	redisTestServer.Close()
+	limiter3 := NewClientRateLimiter(testLog, map[string]float64{QueueNameFastTrack: 2}, redisTestState)
+	require.True(t, limiter3.Allow("client1", QueueNameFastTrack))
+	require.True(t, limiter3.Allow("client1", QueueNameFastTrack))
+	require.False(t, limiter3.Allow("client1", QueueNameFastTrack))
+	resetTestRedis()
+}
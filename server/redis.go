@@ -8,7 +8,14 @@ import (
 	"github.com/pkg/errors"
 )
 
-var RedisKeyNodes = RedisPrefix + "prio-load-balancer:nodes"
+var (
+	RedisKeyNodes   = RedisPrefix + "prio-load-balancer:nodes"
+	RedisKeyAPIKeys = RedisPrefix + "prio-load-balancer:apikeys"
+
+	RedisKeyNodeEvents = RedisPrefix + "prio-load-balancer:node-events"
+
+	RedisKeyRateLimitPrefix = RedisPrefix + "prio-load-balancer:ratelimit:"
+)
 
 type RedisState struct {
 	RedisClient *redis.Client
@@ -24,8 +31,8 @@ func NewRedisState(redisURI string) (*RedisState, error) {
 	}, nil
 }
 
-func (s *RedisState) SaveNodes(nodeUris []string) error {
-	msg, err := json.Marshal(nodeUris)
+func (s *RedisState) SaveNodes(nodeConfigs []NodeConfig) error {
+	msg, err := json.Marshal(nodeConfigs)
 	if err != nil {
 		return err
 	}
@@ -33,19 +40,96 @@ func (s *RedisState) SaveNodes(nodeUris []string) error {
 	return err
 }
 
-func (s *RedisState) GetNodes() (nodeUris []string, err error) {
+// GetNodes returns the saved node configs. Also supports the legacy format (list of node URIs).
+func (s *RedisState) GetNodes() (nodeConfigs []NodeConfig, err error) {
 	res, err := s.RedisClient.Get(context.Background(), RedisKeyNodes).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nodeUris, nil
+			return nodeConfigs, nil
 		}
 		return nil, err
 	}
 
-	err = json.Unmarshal([]byte(res), &nodeUris)
+	err = json.Unmarshal([]byte(res), &nodeConfigs)
+	if err == nil {
+		return nodeConfigs, nil
+	}
+
+	// Legacy format
+	nodeUris := []string{}
+	if json.Unmarshal([]byte(res), &nodeUris) != nil {
+		return nil, err
+	}
+	nodeConfigs = []NodeConfig{}
+	for _, uri := range nodeUris {
+		nodeConfigs = append(nodeConfigs, NodeConfig{URI: uri})
+	}
+	return nodeConfigs, nil
+}
+
+// AddNodeEvent appends an event to the node pool audit trail, which keeps about the last NodeEventsMax events
+func (s *RedisState) AddNodeEvent(event NodeEvent) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.RedisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: RedisKeyNodeEvents,
+		MaxLen: int64(NodeEventsMax),
+		Approx: true,
+		Values: map[string]interface{}{"event": msg},
+	}).Err()
+}
+
+// GetNodeEvents returns up to count node pool events older than the event with the given ID (or the newest
+// events if before is empty), newest first
+func (s *RedisState) GetNodeEvents(before string, count int64) (events []NodeEvent, err error) {
+	end, n := "+", count
+	if before != "" {
+		// Inclusive bound, the exclusive one ("(" + before) needs Redis 6.2. The event before is dropped below.
+		end, n = before, count+1
+	}
+	msgs, err := s.RedisClient.XRevRangeN(context.Background(), RedisKeyNodeEvents, end, "-", n).Result()
 	if err != nil {
 		return nil, err
 	}
+	if len(msgs) > 0 && msgs[0].ID == before {
+		msgs = msgs[1:]
+	}
+	if int64(len(msgs)) > count {
+		msgs = msgs[:count]
+	}
+
+	events = make([]NodeEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		data, _ := msg.Values["event"].(string)
+		event := NodeEvent{}
+		if err = json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, errors.Wrapf(err, "parsing node event %s failed", msg.ID)
+		}
+		event.ID = msg.ID
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (s *RedisState) SaveAPIKeys(configs []APIKeyConfig) error {
+	msg, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	return s.RedisClient.Set(context.Background(), RedisKeyAPIKeys, msg, 0).Err()
+}
+
+func (s *RedisState) GetAPIKeys() (configs []APIKeyConfig, err error) {
+	res, err := s.RedisClient.Get(context.Background(), RedisKeyAPIKeys).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return configs, nil
+		}
+		return nil, err
+	}
 
-	return nodeUris, nil
+	err = json.Unmarshal([]byte(res), &configs)
+	return configs, err
 }
@@ -3,7 +3,7 @@ package server
 import (
 	"testing"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -42,10 +42,23 @@ func TestRedisNodes(t *testing.T) {
 	require.Nil(t, err, err)
 	require.Equal(t, 0, len(nodes0))
 
-	err = redisTestState.SaveNodes([]string{"http://localhost:12431", "http://localhost:12432"})
+	err = redisTestState.SaveNodes([]NodeConfig{{URI: "http://localhost:12431"}, {URI: "http://localhost:12432", Weight: 3, Labels: map[string]string{"type": "archive"}}})
 	require.Nil(t, err, err)
 
 	nodes2, err := redisTestState.GetNodes()
 	require.Nil(t, err, err)
 	require.Equal(t, 2, len(nodes2))
+	require.Equal(t, 3, nodes2[1].Weight)
+	require.Equal(t, "archive", nodes2[1].Labels["type"])
+}
+
+func TestRedisNodesLegacyFormat(t *testing.T) {
+	resetTestRedis()
+
+	err := redisTestServer.Set(RedisKeyNodes, `["http://localhost:12431","http://localhost:12432?_workers=4"]`)
+	require.Nil(t, err, err)
+
+	nodes, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []NodeConfig{{URI: "http://localhost:12431"}, {URI: "http://localhost:12432?_workers=4"}}, nodes)
 }
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// RoutingRule restricts which nodes may serve the requests it matches. All given match conditions
+// (methods, headers, queues) must be met for a rule to match.
+type RoutingRule struct {
+	Name    string            `json:"name,omitempty"`
+	Methods []string          `json:"methods,omitempty"` // JSON-RPC methods, empty matches any method
+	Headers map[string]string `json:"headers,omitempty"` // request headers which need to have the given value
+	Queues  []string          `json:"queues,omitempty"`  // priority classes (fast-track, high-prio, low-prio), empty matches any
+
+	// The request may only be served by nodes which have all labels of at least one of these label sets
+	NodeLabels []map[string]string `json:"nodeLabels"`
+}
+
+// RoutingRules is an ordered list of rules, the first matching rule applies
+type RoutingRules []RoutingRule
+
+// LoadRoutingRules reads the routing rules from a JSON file
+func LoadRoutingRules(filename string) (RoutingRules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading routing rules failed")
+	}
+
+	rules := RoutingRules{}
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "parsing routing rules failed")
+	}
+
+	for i, rule := range rules {
+		if len(rule.NodeLabels) == 0 {
+			return nil, errors.Errorf("routing rule %d (%s) has no nodeLabels", i, rule.Name)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *RoutingRule) matches(method string, header http.Header, queue string) bool {
+	if len(rule.Methods) > 0 && !containsString(rule.Methods, method) {
+		return false
+	}
+	if len(rule.Queues) > 0 && !containsString(rule.Queues, queue) {
+		return false
+	}
+	for key, value := range rule.Headers {
+		if header.Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the first rule matching the request, or nil if no rule matches
+func (rules RoutingRules) Match(method string, header http.Header, queue string) *RoutingRule {
+	for i := range rules {
+		if rules[i].matches(method, header, queue) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// labelsMatch returns true if labels contain all key/value pairs of at least one of the label sets,
+// or if no label sets are given
+func labelsMatch(labels map[string]string, labelSets []map[string]string) bool {
+	if len(labelSets) == 0 {
+		return true
+	}
+
+	for _, labelSet := range labelSets {
+		match := true
+		for key, value := range labelSet {
+			if labels[key] != value {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingRulesMatch(t *testing.T) {
+	rules := RoutingRules{
+		{Name: "trace", Methods: []string{"debug_traceCall"}, NodeLabels: []map[string]string{{"archive": "true"}}},
+		{Name: "builder", Headers: map[string]string{"X-Client": "builder"}, Queues: []string{QueueNameFastTrack}, NodeLabels: []map[string]string{{"region": "eu"}}},
+	}
+
+	require.Equal(t, "trace", rules.Match("debug_traceCall", http.Header{}, QueueNameLowPrio).Name)
+	require.Nil(t, rules.Match("eth_callBundle", http.Header{}, QueueNameFastTrack))
+
+	header := http.Header{}
+	header.Set("X-Client", "builder")
+	require.Equal(t, "builder", rules.Match("eth_callBundle", header, QueueNameFastTrack).Name)
+	require.Nil(t, rules.Match("eth_callBundle", header, QueueNameHighPrio))
+}
+
+func TestLabelsMatch(t *testing.T) {
+	labels := map[string]string{"region": "eu", "archive": "true"}
+	require.True(t, labelsMatch(labels, nil))
+	require.True(t, labelsMatch(labels, []map[string]string{{"region": "eu"}}))
+	require.True(t, labelsMatch(labels, []map[string]string{{"region": "us"}, {"archive": "true"}}))
+	require.False(t, labelsMatch(labels, []map[string]string{{"region": "eu", "archive": "false"}}))
+	require.False(t, labelsMatch(nil, []map[string]string{{"region": "eu"}}))
+}
+
+func TestLoadRoutingRules(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "rules.json")
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"trace","methods":["debug_traceCall"],"nodeLabels":[{"archive":"true"}]}]`), 0o600))
+	rules, err := LoadRoutingRules(fn)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(rules))
+	require.Equal(t, []string{"debug_traceCall"}, rules[0].Methods)
+
+	// Rules without nodeLabels are invalid
+	require.Nil(t, os.WriteFile(fn, []byte(`[{"name":"trace","methods":["debug_traceCall"]}]`), 0o600))
+	_, err = LoadRoutingRules(fn)
+	require.NotNil(t, err)
+}
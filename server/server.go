@@ -1,12 +1,17 @@
 package server
 
 import (
-	"context"
+	"net"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"go.uber.org/zap"
 )
 
+// blockWaitRecheckInterval is how often a request that waits for a block is put back into the queue
+var blockWaitRecheckInterval = 50 * time.Millisecond
+
 type ServerOpts struct {
 	Log            *zap.SugaredLogger
 	HTTPAddrPtr    string // listen address for the webserver
@@ -22,17 +27,42 @@ type Server struct {
 	prioQueue *PrioQueue
 	nodePool  *NodePool
 	webserver *Webserver
+
+	routingRules  RoutingRules
+	priorityRules PriorityRules
+	admission     *AdmissionController
+	apiKeys       *APIKeyStore
+	rateLimiter   *ClientRateLimiter
+
+	trustedProxies []*net.IPNet
 }
 
 // NewServer creates a new Server instance, loads the nodes from Redis and starts the node workers
 func NewServer(opts ServerOpts) (*Server, error) {
+	if err := ValidateAdminConfig(); err != nil {
+		return nil, err
+	}
+
 	var err error
 	s := Server{
-		opts:      opts,
-		log:       opts.Log,
-		prioQueue: NewPrioQueue(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, FastTrackDrainFirst),
+		opts: opts,
+		log:  opts.Log,
 	}
 
+	queueClasses := DefaultQueueClasses(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, FastTrackDrainFirst, LowPrioAgingThresholdMs)
+	if QueueClassesFile != "" {
+		queueClasses, err = LoadQueueClasses(QueueClassesFile)
+		if err != nil {
+			return nil, err
+		}
+		s.log.Infow("Loaded queue classes", "file", QueueClassesFile, "classes", queueClasses)
+	}
+	s.prioQueue, err = NewPrioQueueWithClasses(queueClasses)
+	if err != nil {
+		return nil, err
+	}
+	s.admission = NewAdmissionController(AdmissionTarget, AdmissionInterval, len(queueClasses), s.prioQueue.NumRequests)
+
 	if s.opts.RedisURI == "" {
 		s.log.Info("Not using Redis because no RedisURI provided")
 	} else {
@@ -43,15 +73,59 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		}
 	}
 
+	s.trustedProxies, err = ParseTrustedProxies(TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if ClientIDHeader != "" && len(s.trustedProxies) == 0 {
+		return nil, errors.New("CLIENT_ID_HEADER requires TRUSTED_PROXIES")
+	}
+
+	rateLimits, err := ParseRateLimits(RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	s.rateLimiter = NewClientRateLimiter(s.log, rateLimits, s.redis)
+
+	if RoutingRulesFile != "" {
+		s.routingRules, err = LoadRoutingRules(RoutingRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		s.log.Infow("Loaded routing rules", "file", RoutingRulesFile, "numRules", len(s.routingRules))
+	}
+
+	if PriorityRulesFile != "" {
+		s.priorityRules, err = LoadPriorityRules(PriorityRulesFile, s.prioQueue.ClassNames())
+		if err != nil {
+			return nil, err
+		}
+		s.log.Infow("Loaded priority rules", "file", PriorityRulesFile, "numRules", len(s.priorityRules))
+	}
+
 	if opts.WorkersPerNode == 0 {
 		s.log.Warn("WorkersPerNode is 0! This is not recommended. Use at least 1.")
 	}
 
+	balancer, err := NewBalancer(NodeBalancer)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Infow("Using node balancer", "strategy", NodeBalancer)
+
 	s.nodePool = NewNodePool(s.log, s.redis, s.opts.WorkersPerNode)
+	s.nodePool.SetBalancer(balancer)
 	err = s.nodePool.LoadNodesFromRedis()
 	if err != nil {
 		return nil, err
 	}
+	s.nodePool.StartHeadTracker()
+
+	s.apiKeys = NewAPIKeyStore(s.log, s.redis)
+	err = s.apiKeys.LoadFromRedis()
+	if err != nil {
+		return nil, err
+	}
 
 	return &s, nil
 }
@@ -61,6 +135,12 @@ func (s *Server) Start() {
 	// Setup and start the webserver
 	s.log.Infow("Starting webserver", "listenAddr", s.opts.HTTPAddrPtr)
 	s.webserver = NewWebserver(s.log, s.opts.HTTPAddrPtr, s.prioQueue, s.nodePool)
+	s.webserver.routingRules = s.routingRules
+	s.webserver.priorityRules = s.priorityRules
+	s.webserver.admission = s.admission
+	s.webserver.apiKeys = s.apiKeys
+	s.webserver.rateLimiter = s.rateLimiter
+	s.webserver.trustedProxies = s.trustedProxies
 	s.webserver.Start()
 
 	// Main loop: send simqueue jobs to node pool
@@ -71,49 +151,87 @@ func (s *Server) Start() {
 			s.log.Info("Shutting down main loop (request is nil)")
 			return
 		}
+		updateQueueMetrics(s.prioQueue)
+		s.admission.RecordSojourn(time.Since(r.queuedAt))
 
-		if r.Cancelled {
+		if r.IsCancelled() {
 			continue
 		}
 
-		if time.Since(r.CreatedAt) > RequestTimeout {
-			s.log.Info("request timed out before processing")
+		if r.DeadlineExceeded(0) {
+			s.log.Infow("request timed out before processing", "deadline", r.Deadline)
+			metricRequestsRejected.WithLabelValues(RejectReasonRequestTimeout).Inc()
 			r.SendResponse(SimResponse{Error: ErrRequestTimeout})
 			continue
 		}
 
-		// Return an error if no nodes are available
-		if len(s.nodePool.nodes) == 0 {
+		// Return an error if no nodes are available (none added, or all unhealthy)
+		if s.nodePool.NumAvailableNodes() == 0 {
 			s.log.Error("no execution nodes available")
+			metricRequestsRejected.WithLabelValues(RejectReasonNoNodes).Inc()
 			r.SendResponse(SimResponse{Error: ErrNoNodesAvailable})
 			continue
 		}
 
+		// Hold requests for a block that no node has yet, until a node catches up or BlockWaitTimeout is hit. If no
+		// node may process the request at all, waiting for the block doesn't help.
+		if r.MinBlockNumber > 0 {
+			hasNode, hasBlock := s.nodePool.HasNodeWithBlock(r)
+			if !hasNode {
+				s.log.Warnw("no execution node may process the request", "nodeLabels", r.NodeLabels, "payloadSize", len(r.Payload))
+				metricRequestsRejected.WithLabelValues(RejectReasonNoNodes).Inc()
+				r.SendResponse(SimResponse{Error: ErrNoNodesAvailable})
+				continue
+			} else if !hasBlock {
+				s.holdRequestForBlock(r)
+				continue
+			}
+		}
+
 		// Forward to a node for processing
-		select {
-		case s.nodePool.JobC <- r:
-			// Job was taken by a node
-		case <-time.After(ServerJobSendTimeout):
+		err := s.nodePool.Dispatch(r, ServerJobSendTimeout)
+		if err == ErrNoNodesAvailable {
+			s.log.Warnw("no execution node may process the request", "nodeLabels", r.NodeLabels, "payloadSize", len(r.Payload))
+			metricRequestsRejected.WithLabelValues(RejectReasonNoNodes).Inc()
+			r.SendResponse(SimResponse{Error: err})
+		} else if err != nil {
 			// Job was NOT taken by a node - cancel request
 			s.log.Warnw("job was not taken by a node", "requestsInQueue", s.prioQueue.NumRequests())
-			r.SendResponse(SimResponse{Error: ErrNodeTimeout})
+			metricRequestsRejected.WithLabelValues(RejectReasonNodeTimeout).Inc()
+			r.SendResponse(SimResponse{Error: err})
 		}
 	}
 }
 
+// holdRequestForBlock puts a request back into the queue after a short delay, or fails it if it has been waiting for longer than BlockWaitTimeout
+func (s *Server) holdRequestForBlock(r *SimRequest) {
+	if time.Since(r.CreatedAt) > BlockWaitTimeout {
+		s.log.Infow("no node has the requested block", "minBlockNumber", r.MinBlockNumber, "bestHead", s.nodePool.BestHead())
+		metricRequestsRejected.WithLabelValues(RejectReasonBlockNotAvail).Inc()
+		r.SendResponse(SimResponse{Error: ErrBlockNotAvailable})
+		return
+	}
+
+	time.AfterFunc(blockWaitRecheckInterval, func() {
+		if !s.prioQueue.Push(r) {
+			r.SendResponse(SimResponse{Error: ErrBlockNotAvailable})
+		}
+	})
+}
+
 // Shutdown gracefully shuts down the server. Allows ongoing requests to complete, but no
 // further requests will be accepted or those from the queue processed.
 func (s *Server) Shutdown() {
 	s.log.Info("Shutting down server")
 	s.prioQueue.Close()
-	s.webserver.srv.Shutdown(context.Background()) // stop incoming requests
-	s.nodePool.Shutdown()                          // stop the execution workers
+	s.webserver.Shutdown() // stop incoming requests
+	s.nodePool.Shutdown()  // stop the execution workers
 }
 
 // AddNode adds a new execution node to the pool and starts the workers. If a new node is added,
 // the list of nodes is saved to redis.
 func (s *Server) AddNode(uri string) error {
-	return s.nodePool.AddNode(uri)
+	return s.nodePool.addNode(NodeConfig{URI: uri}, NodeChangeOrigin{Source: NodeChangeSourceCLI}, false)
 }
 
 // NumNodeWorkersAlive returns the number of currently active node workers
@@ -20,6 +20,8 @@ var (
 	testLog              = testLogger.Sugar()
 )
 
+const testRequestPayload = `{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`
+
 func TestServerWithoutRedis(t *testing.T) {
 	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 1})
 	require.Nil(t, err, err)
@@ -32,12 +34,12 @@ func TestServerWithoutRedis(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // give Github CI time to start the webserver
 
 	url := "http://" + testServerListenAddr
-	resp, err := http.PostForm(url, nil)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(testRequestPayload))
 	require.Nil(t, err, err)
 	require.Equal(t, 200, resp.StatusCode)
 
 	url = "http://" + testServerListenAddr + "/"
-	resp, err = http.PostForm(url, nil)
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(testRequestPayload))
 	require.Nil(t, err, err)
 	require.Equal(t, 200, resp.StatusCode)
 }
@@ -56,7 +58,7 @@ func TestServerWithRedis(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // give Github CI time to start the webserver
 
 	url := "http://" + testServerListenAddr + "/"
-	resp, err := http.PostForm(url, nil)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(testRequestPayload))
 	require.Nil(t, err, err)
 	require.Equal(t, 200, resp.StatusCode)
 }
@@ -69,12 +71,23 @@ func TestServerNoNodes(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // give Github CI time to start the webserver
 
 	url := "http://" + testServerListenAddr
-	resp, err := http.PostForm(url, nil)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(testRequestPayload))
 	require.Nil(t, err, err)
 	require.Equal(t, 500, resp.StatusCode)
 
 	bb, _ := io.ReadAll(resp.Body)
 	require.Contains(t, string(bb), "no nodes")
+
+	// With JSON-RPC errors
+	JSONRPCErrors = true
+	defer func() { JSONRPCErrors = false }()
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(testRequestPayload))
+	require.Nil(t, err, err)
+	require.Equal(t, 503, resp.StatusCode)
+	rpcResp := JSONRPCResponse{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+	require.Equal(t, float64(1), rpcResp.ID)
+	require.Equal(t, JSONRPCErrNoNodesAvailable, rpcResp.Error.Code)
 }
 
 // TestServerShutdown tests the graceful shutdown of the server
@@ -98,7 +111,6 @@ func TestServerShutdown(t *testing.T) {
 func TestServerJobTimeout(t *testing.T) {
 	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 0}) // 0 workers per node -> no jobs can be picked up
 	require.Nil(t, err, err)
-	s.nodePool.JobC = make(chan *SimRequest) // disable buffer on job queue
 
 	mockNodeBackend := testutils.NewMockNodeBackend()
 	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
@@ -117,3 +129,51 @@ func TestServerJobTimeout(t *testing.T) {
 	lenFT, lenHP, lenLP := s.prioQueue.Len()
 	require.Equal(t, 0, lenFT+lenHP+lenLP)
 }
+
+// TestServerBlockRouting ensures that requests for a block no node has yet are held until a node catches up
+func TestServerBlockRouting(t *testing.T) {
+	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 1})
+	require.Nil(t, err, err)
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeBackend.BlockNumber = 100
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	s.AddNode(mockNodeServer.URL)
+	s.nodePool.UpdateHeads()
+	s.routingRules = RoutingRules{{Headers: map[string]string{"X-Archive": "true"}, NodeLabels: []map[string]string{{"archive": "true"}}}}
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond) // give Github CI time to start the webserver
+
+	url := "http://" + testServerListenAddr
+	reqPayload := `{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"blockNumber":"0x66","stateBlockNumber":"latest"}]}`
+
+	// Node is at block 100, request needs block 101 -> held until the node catches up
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		mockNodeBackend.BlockNumber = 101
+		s.nodePool.UpdateHeads()
+	}()
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(reqPayload))
+	require.Nil(t, err, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	// Request needs block 102, which no node gets within BlockWaitTimeout
+	reqPayload = `{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":[],"blockNumber":"0x67","stateBlockNumber":"latest"}]}`
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(reqPayload))
+	require.Nil(t, err, err)
+	require.Equal(t, 500, resp.StatusCode)
+	bb, _ := io.ReadAll(resp.Body)
+	require.Contains(t, string(bb), ErrBlockNotAvailable.Error())
+
+	// No node may process the request at all -> fails right away
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString(reqPayload))
+	req.Header.Set("X-Archive", "true")
+	timeStarted := time.Now()
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err, err)
+	require.Equal(t, 500, resp.StatusCode)
+	bb, _ = io.ReadAll(resp.Body)
+	require.Contains(t, string(bb), ErrNoNodesAvailable.Error())
+	require.Less(t, time.Since(timeStarted), BlockWaitTimeout)
+}
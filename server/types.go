@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,27 +11,76 @@ type SimRequest struct {
 	ID          string
 	IsHighPrio  bool
 	IsFastTrack bool
+	QueueClass  string // name of the queue class (see QueueClass), if empty it's derived from IsFastTrack and IsHighPrio
 
 	Payload   []byte
 	ResponseC chan SimResponse
-	Cancelled bool
 	CreatedAt time.Time
+	Deadline  time.Time // if set, the request is dropped if it can't be processed before (see DeadlineExceeded)
 	Tries     int
 	Context   context.Context
+
+	MinBlockNumber uint64              // if set, the request is only processed by nodes which have at least this block
+	RoutingKey     string              // used by the consistent-hash balancer to select the node (defaults to the payload)
+	ClientID       string              // identity of the client, for fair queuing and rate limits (API key client, ClientIDHeader of a trusted proxy or source IP)
+	NodeLabels     []map[string]string // if set, only nodes matching one of the label sets may process the request (see RoutingRule)
+
+	cancelled     atomic.Bool
+	cancelContext context.CancelFunc
+
+	// position in the PrioQueue, set while the request is queued
+	queueIndex    int
+	ageIndex      int // position in the age heap of the class, if it has an aging threshold
+	queueSeq      uint64
+	queueDeadline time.Time
+	queuedAt      time.Time
 }
 
 func NewSimRequest(ctx context.Context, id string, payload []byte, isHighPrio, IsFastTrack bool) *SimRequest {
+	ctx, cancel := context.WithCancel(ctx)
 	return &SimRequest{
-		ID:          id,
-		Payload:     payload,
-		IsHighPrio:  isHighPrio,
-		IsFastTrack: IsFastTrack,
-		ResponseC:   make(chan SimResponse, 1),
-		CreatedAt:   time.Now().UTC(),
-		Context:     ctx,
+		ID:            id,
+		Payload:       payload,
+		IsHighPrio:    isHighPrio,
+		IsFastTrack:   IsFastTrack,
+		ResponseC:     make(chan SimResponse, 1),
+		CreatedAt:     time.Now().UTC(),
+		Context:       ctx,
+		cancelContext: cancel,
+		queueIndex:    -1,
+		ageIndex:      -1,
 	}
 }
 
+// Cancel marks the request as cancelled, so it won't be processed anymore, and aborts the proxy request if it's in flight
+func (r *SimRequest) Cancel() {
+	r.cancelled.Store(true)
+	r.cancelContext()
+}
+
+func (r *SimRequest) IsCancelled() bool {
+	return r.cancelled.Load()
+}
+
+// SchedulingDeadline returns the time until which the request needs to be processed: the deadline if set,
+// or when RequestTimeout is hit if that's earlier. Requests in a queue class are processed earliest deadline first.
+func (r *SimRequest) SchedulingDeadline() time.Time {
+	timeout := r.CreatedAt.Add(RequestTimeout)
+	if !r.Deadline.IsZero() && r.Deadline.Before(timeout) {
+		return r.Deadline
+	}
+	return timeout
+}
+
+// DeadlineExceeded returns true if the request waited longer than RequestTimeout, or if its deadline can't be met
+// anymore when processing takes expectedDuration
+func (r *SimRequest) DeadlineExceeded(expectedDuration time.Duration) bool {
+	if time.Since(r.CreatedAt) > RequestTimeout {
+		return true
+	}
+	return !r.Deadline.IsZero() && time.Until(r.Deadline) < expectedDuration
+}
+
 // SendResponse sends the response to ResponseC. If noone is listening on the channel, it is dropped.
 func (r *SimRequest) SendResponse(resp SimResponse) (wasSent bool) {
 	select {
@@ -50,3 +100,55 @@ type SimResponse struct {
 	SimDuration time.Duration
 	SimAt       time.Time // time when proxying started
 }
+
+// NodeConfig describes an execution node, as accepted by the API and persisted in Redis
+type NodeConfig struct {
+	URI            string            `json:"uri"`
+	Workers        int32             `json:"workers,omitempty"`        // number of workers, 0 means default (or `?_workers=` in the URI)
+	Weight         int               `json:"weight,omitempty"`         // share of requests relative to other nodes, 0 means number of workers
+	Labels         map[string]string `json:"labels,omitempty"`         // arbitrary labels, i.e. for routing rules
+	MaxPayloadSize int               `json:"maxPayloadSize,omitempty"` // max request payload size in bytes, 0 means no limit
+	Enabled        *bool             `json:"enabled,omitempty"`        // disabled nodes stay in the pool but don't take jobs (default: true)
+	Notes          string            `json:"notes,omitempty"`
+}
+
+// Node pool changes in the audit trail
+const (
+	NodeEventAdd     = "add"
+	NodeEventUpdate  = "update"
+	NodeEventRemove  = "remove"
+	NodeEventLoad    = "load" // nodes loaded from redis at startup
+	NodeEventDrain   = "drain"
+	NodeEventUndrain = "undrain"
+	NodeEventResize  = "resize" // number of workers changed
+
+	NodeChangeSourceAPI      = "api"      // admin API
+	NodeChangeSourceCLI      = "cli"      // CLI flags or env vars
+	NodeChangeSourceRedis    = "redis"    // node list in redis
+	NodeChangeSourceDrain    = "drain"    // removed after draining
+	NodeChangeSourceInternal = "internal" // any other caller
+)
+
+// NodeChangeOrigin tells who changed the node pool, for the audit trail
+type NodeChangeOrigin struct {
+	Actor  string // i.e. the admin API actor (see AdminActor), "system" if empty
+	Source string // NodeChangeSource*
+}
+
+// NodeEvent is a change of the node pool, as stored in the audit trail in redis
+type NodeEvent struct {
+	ID        string       `json:"id"` // redis stream ID
+	Timestamp time.Time    `json:"timestamp"`
+	Action    string       `json:"action"` // NodeEvent*
+	URI       string       `json:"uri,omitempty"`
+	Actor     string       `json:"actor"`
+	Source    string       `json:"source"`
+	Instance  string       `json:"instance"` // hostname of the balancer instance
+	Before    []NodeConfig `json:"before"`
+	After     []NodeConfig `json:"after"`
+}
+
+// IsEnabled returns true unless the node was explicitly disabled
+func (c NodeConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
@@ -21,3 +21,12 @@ func GetEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MethodFilter decides which JSON-RPC methods may be forwarded to the nodes. Patterns are method names,
+// or prefixes ending in `*` (i.e. `debug_*`). Denied methods take precedence over allowed ones, and an
+// empty allowlist allows all methods which are not denied.
+type MethodFilter struct {
+	allow []string
+	deny  []string
+}
+
+func NewMethodFilter(allow, deny []string) *MethodFilter {
+	return &MethodFilter{
+		allow: allow,
+		deny:  deny,
+	}
+}
+
+// IsAllowed returns true if the method may be forwarded to the nodes
+func (f *MethodFilter) IsAllowed(method string) bool {
+	if f == nil {
+		return true
+	}
+	if methodMatchesAny(method, f.deny) {
+		return false
+	}
+	return len(f.allow) == 0 || methodMatchesAny(method, f.allow)
+}
+
+func methodMatchesAny(method string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, isPrefix := strings.CutSuffix(pattern, "*"); isPrefix && strings.HasPrefix(method, prefix) {
+			return true
+		} else if method == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMethodList splits a comma-separated list of method patterns
+func parseMethodList(s string) []string {
+	methods := []string{}
+	for _, method := range strings.Split(s, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// ValidateJSONRPCRequest checks the JSON-RPC envelope of a request and whether the method is allowed. On
+// failure it returns the id of the request (if any) and the JSON-RPC error to respond with.
+func ValidateJSONRPCRequest(payload []byte, filter *MethodFilter) (id interface{}, rpcErr *JSONRPCError) {
+	req := struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params"`
+	}{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		if json.Valid(payload) { // valid JSON, but not an object with the expected fields
+			return nil, &JSONRPCError{Code: JSONRPCErrInvalidRequest, Message: "invalid request"}
+		}
+		return nil, &JSONRPCError{Code: JSONRPCErrParse, Message: "parse error"}
+	}
+	if len(req.ID) > 0 {
+		id = req.ID
+	}
+
+	if req.Version != "2.0" {
+		return id, &JSONRPCError{Code: JSONRPCErrInvalidRequest, Message: "invalid request: jsonrpc must be \"2.0\""}
+	}
+	if req.Method == "" {
+		return id, &JSONRPCError{Code: JSONRPCErrInvalidRequest, Message: "invalid request: missing method"}
+	}
+	if params := bytes.TrimSpace(req.Params); len(params) > 0 && params[0] != '[' && params[0] != '{' && !bytes.Equal(params, []byte("null")) {
+		return id, &JSONRPCError{Code: JSONRPCErrInvalidRequest, Message: "invalid request: params must be an array or object"}
+	}
+	if !filter.IsAllowed(req.Method) {
+		return id, &JSONRPCError{Code: JSONRPCErrMethodNotFound, Message: fmt.Sprintf("the method %s does not exist/is not available", req.Method)}
+	}
+	return id, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodFilter(t *testing.T) {
+	f := NewMethodFilter(nil, parseMethodList("admin_*, debug_*,personal_sign"))
+	require.True(t, f.IsAllowed("eth_callBundle"))
+	require.False(t, f.IsAllowed("admin_addPeer"))
+	require.False(t, f.IsAllowed("debug_traceCall"))
+	require.False(t, f.IsAllowed("personal_sign"))
+	require.True(t, f.IsAllowed("personal_listAccounts"))
+
+	f = NewMethodFilter(parseMethodList("eth_*,net_version"), parseMethodList("eth_sendRawTransaction"))
+	require.True(t, f.IsAllowed("eth_callBundle"))
+	require.True(t, f.IsAllowed("net_version"))
+	require.False(t, f.IsAllowed("net_peerCount"))
+	require.False(t, f.IsAllowed("eth_sendRawTransaction"))
+
+	var nilFilter *MethodFilter
+	require.True(t, nilFilter.IsAllowed("admin_addPeer"))
+}
+
+func TestValidateJSONRPCRequest(t *testing.T) {
+	filter := NewMethodFilter(nil, []string{"debug_*"})
+	testCases := []struct {
+		payload      string
+		expectedCode int // 0 means valid
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`, 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":{}}`, 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle"}`, 0},
+		{`{"jsonrpc":"2.0","method":"eth_callBundle","params":[]}`, 0},
+		{`foo`, JSONRPCErrParse},
+		{``, JSONRPCErrParse},
+		{`"foo"`, JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"1.0","id":1,"method":"eth_callBundle","params":[]}`, JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"params":[]}`, JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"method":1,"params":[]}`, JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":"foo"}`, JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"method":"debug_traceCall","params":[]}`, JSONRPCErrMethodNotFound},
+	}
+
+	for _, testCase := range testCases {
+		_, rpcErr := ValidateJSONRPCRequest([]byte(testCase.payload), filter)
+		if testCase.expectedCode == 0 {
+			require.Nil(t, rpcErr, testCase.payload)
+		} else {
+			require.NotNil(t, rpcErr, testCase.payload)
+			require.Equal(t, testCase.expectedCode, rpcErr.Code, testCase.payload)
+		}
+	}
+
+	// The id of the request is returned with the error
+	id, rpcErr := ValidateJSONRPCRequest([]byte(`{"jsonrpc":"2.0","id":"abc","method":"debug_traceCall","params":[]}`), filter)
+	require.NotNil(t, rpcErr)
+	require.Equal(t, json.RawMessage(`"abc"`), id)
+}
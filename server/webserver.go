@@ -2,15 +2,21 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +26,16 @@ type Webserver struct {
 	prioQueue  *PrioQueue
 	nodePool   *NodePool
 	srv        *http.Server
+	adminSrv   *http.Server
+
+	routingRules  RoutingRules
+	priorityRules PriorityRules
+	methodFilter  *MethodFilter
+	admission     *AdmissionController
+	apiKeys       *APIKeyStore
+	rateLimiter   *ClientRateLimiter
+
+	trustedProxies []*net.IPNet // proxies whose ClientIDHeader is used as client ID
 }
 
 func NewWebserver(log *zap.SugaredLogger, listenAddr string, prioQueue *PrioQueue, nodePool *NodePool) *Webserver {
@@ -28,31 +44,49 @@ func NewWebserver(log *zap.SugaredLogger, listenAddr string, prioQueue *PrioQueu
 		listenAddr: listenAddr,
 		prioQueue:  prioQueue,
 		nodePool:   nodePool,
+
+		methodFilter: NewMethodFilter(parseMethodList(MethodsAllow), parseMethodList(MethodsDeny)),
+		apiKeys:      NewAPIKeyStore(log, nil),
 	}
 }
 
-func (s *Webserver) Start() {
-	r := mux.NewRouter()
-	r.HandleFunc("/", s.HandleRootRequest).Methods(http.MethodGet)
-	r.HandleFunc("/", s.HandleQueueRequest).Methods(http.MethodPost)
-	r.HandleFunc("/sim", s.HandleQueueRequest).Methods(http.MethodPost)
-	r.HandleFunc("/nodes", s.HandleNodesRequest).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+// Routers returns the router for the proxy traffic and the router for the admin API (/nodes, /apikeys, /metrics
+// and the debug APIs). Without an admin listen address, the admin API is served by the public router as well.
+func (s *Webserver) Routers() (public, admin *mux.Router) {
+	public = mux.NewRouter()
+	public.HandleFunc("/", s.HandleRootRequest).Methods(http.MethodGet)
+	public.HandleFunc("/", s.HandleQueueRequest).Methods(http.MethodPost)
+	public.HandleFunc("/sim", s.HandleQueueRequest).Methods(http.MethodPost)
+	public.PathPrefix("/sim/").HandlerFunc(s.HandleQueueRequest).Methods(http.MethodPost) // i.e. for priority rules by path prefix
+
+	admin = public
+	if AdminListenAddr != "" {
+		admin = mux.NewRouter()
+	}
+	admin.Handle("/nodes/events", s.adminMiddleware(http.HandlerFunc(s.HandleNodeEventsRequest))).Methods(http.MethodGet)
+	admin.Handle("/nodes", s.adminMiddleware(http.HandlerFunc(s.HandleNodesRequest))).Methods(http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete)
+	admin.Handle("/apikeys", s.adminMiddleware(http.HandlerFunc(s.HandleAPIKeysRequest))).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	admin.Handle("/metrics", s.adminMiddleware(promhttp.Handler())).Methods(http.MethodGet)
 
 	if EnablePprof {
 		s.log.Info("Enabling pprof")
-		r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+		admin.PathPrefix("/debug/pprof/").Handler(s.adminMiddleware(http.DefaultServeMux))
 	}
 
 	if EnableErrorTestAPI {
 		s.log.Info("Enabling error testing API")
-		r.HandleFunc("/debug/testLogLevels", s.HandleTestLogLevels).Methods(http.MethodGet)
+		admin.Handle("/debug/testLogLevels", s.adminMiddleware(http.HandlerFunc(s.HandleTestLogLevels))).Methods(http.MethodGet)
 	}
 
-	loggedRouter := LoggingMiddleware(s.log, r)
+	return public, admin
+}
+
+func (s *Webserver) Start() {
+	public, admin := s.Routers()
 
 	s.srv = &http.Server{
 		Addr:    s.listenAddr,
-		Handler: loggedRouter,
+		Handler: LoggingMiddleware(s.log, public),
 	}
 
 	go func() {
@@ -63,6 +97,47 @@ func (s *Webserver) Start() {
 		s.log.Errorw("Webserver error", "err", err)
 		panic(err)
 	}()
+
+	if AdminListenAddr == "" {
+		s.log.Warn("Serving the admin API on the public listener, set ADMIN_LISTEN_ADDR to separate it")
+		return
+	}
+	if !adminAuthEnabled() {
+		s.log.Warn("Admin API is not authenticated, set ADMIN_TOKEN or ADMIN_TLS_CLIENT_CA_FILE")
+	}
+
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	s.adminSrv = &http.Server{
+		Addr:      AdminListenAddr,
+		Handler:   LoggingMiddleware(s.log, admin),
+		TLSConfig: tlsConfig,
+	}
+
+	s.log.Infow("Starting admin webserver", "listenAddr", AdminListenAddr, "tls", AdminTLSCertFile != "")
+	go func() {
+		var err error
+		if AdminTLSCertFile != "" {
+			err = s.adminSrv.ListenAndServeTLS(AdminTLSCertFile, AdminTLSKeyFile)
+		} else {
+			err = s.adminSrv.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
+		s.log.Errorw("Admin webserver error", "err", err)
+		panic(err)
+	}()
+}
+
+// Shutdown stops the public and the admin listener, and lets ongoing requests complete
+func (s *Webserver) Shutdown() {
+	if s.adminSrv != nil {
+		_ = s.adminSrv.Shutdown(context.Background())
+	}
+	_ = s.srv.Shutdown(context.Background())
 }
 
 func (s *Webserver) HandleRootRequest(w http.ResponseWriter, req *http.Request) {
@@ -89,7 +164,7 @@ func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request)
 	}
 
 	if len(body) > PayloadMaxBytes {
-		http.Error(w, "Payload too large", http.StatusBadRequest)
+		writeRequestError(w, body, ErrPayloadTooLarge, http.StatusBadRequest)
 		return
 	}
 
@@ -99,28 +174,80 @@ func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// Add new sim request to queue
-	isFastTrack := req.Header.Get("X-Fast-Track") == "true"
-	isHighPrio := req.Header.Get("high_prio") == "true" || req.Header.Get("X-High-Priority") == "true"
-	simReq := NewSimRequest(ctx, reqID, body, isHighPrio, isFastTrack)
+	// Check the API key (its quotas are taken per call for batches)
+	apiKey, ok := s.authenticate(w, req, log, body)
+	if !ok {
+		return
+	}
+	if apiKey != nil {
+		log = log.With("client", apiKey.Client)
+	}
+
+	// JSON-RPC batch requests are split into one request per call
+	if BatchRequests && isBatchPayload(body) {
+		s.handleBatchRequest(w, req, log, body, apiKey)
+		return
+	}
+
+	if apiKey != nil {
+		if !apiKey.Acquire() {
+			log.Info("API key quota exceeded")
+			metricRequestsRejected.WithLabelValues(RejectReasonQuotaExceeded).Inc()
+			writeRequestError(w, body, ErrQuotaExceeded, http.StatusTooManyRequests)
+			return
+		}
+		defer apiKey.Release()
+	}
+
+	// Validate the JSON-RPC request before queueing
+	if id, rpcErr := s.validateRequest(body); rpcErr != nil {
+		log.Infow("Invalid request", "error", rpcErr)
+		metricRequestsRejected.WithLabelValues(rejectReasonForJSONRPCError(rpcErr)).Inc()
+		writeJSONRPCError(w, http.StatusBadRequest, id, rpcErr.Code, rpcErr.Message)
+		return
+	}
+
+	// Add new sim request to queue, unless it's shed because the queue delay is too high
+	simReq, log := s.newSimRequest(req, reqID, body, log)
+	if apiKey != nil {
+		simReq.ClientID = apiKey.Client
+		if !apiKey.AllowsQueue(queueName(simReq)) {
+			log.Infow("Priority not allowed for API key", "queueClass", queueName(simReq))
+			metricRequestsRejected.WithLabelValues(RejectReasonQueueNotAllowed).Inc()
+			writeRequestError(w, body, ErrQueueNotAllowed, http.StatusForbidden)
+			return
+		}
+	}
+	if !s.rateLimiter.Allow(simReq.ClientID, queueName(simReq)) {
+		log.Infow("Rate limit exceeded", "clientID", simReq.ClientID, "queueClass", queueName(simReq))
+		metricRequestsRejected.WithLabelValues(RejectReasonRateLimited).Inc()
+		w.Header().Set("Retry-After", "1")
+		writeRequestError(w, body, ErrRateLimited, http.StatusTooManyRequests)
+		return
+	}
+	if !s.admit(simReq) {
+		log.Infow("Request shed, queue delay above target", "queueClass", queueName(simReq))
+		writeOverloadedError(w, body, s.admission.RetryAfter())
+		return
+	}
 	wasAdded := s.prioQueue.Push(simReq)
 	if !wasAdded { // queue was full, job not added
 		log.Error("Couldn't add request, queue is full")
-		http.Error(w, "queue full", http.StatusInternalServerError)
+		metricRequestsRejected.WithLabelValues(RejectReasonQueueFull).Inc()
+		writeRequestError(w, body, ErrQueueFull, http.StatusInternalServerError)
 		return
 	}
 
+	updateQueueMetrics(s.prioQueue)
+
+	isFastTrack, isHighPrio := simReq.IsFastTrack, simReq.IsHighPrio
 	startQueueSizeFastTrack, startQueueSizeHighPrio, startQueueSizeLowPrio := s.prioQueue.Len()
-	startItemQueueSize := startQueueSizeLowPrio
-	if isFastTrack {
-		startItemQueueSize = startQueueSizeFastTrack
-	} else if isHighPrio {
-		startItemQueueSize = startQueueSizeHighPrio
-	}
+	startItemQueueSize := s.prioQueue.ClassLen(queueName(simReq))
 
 	log = log.With(
 		"requestIsHighPrio", isHighPrio,
 		"requestIsFastTrack", isFastTrack,
+		"queueClass", queueName(simReq),
 		"payloadSize", len(body),
 
 		"startQueueSize", s.prioQueue.NumRequests(),
@@ -131,107 +258,531 @@ func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request)
 	log.Infow("Request added to queue")
 
 	// Wait for response or cancel
+	resp, ok := s.waitForResponse(ctx, log, simReq)
+	if !ok {
+		return
+	}
+
+	if resp.Error != nil {
+		if resp.StatusCode == 0 {
+			resp.StatusCode = http.StatusInternalServerError
+		}
+
+		if len(resp.Payload) > 0 {
+			w.WriteHeader(resp.StatusCode)
+			w.Write(resp.Payload)
+			return
+		}
+
+		writeRequestError(w, body, resp.Error, resp.StatusCode)
+		return
+	}
+
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	queueDuration := resp.SimAt.Sub(startTime)
+	queueDurationUs := queueDuration.Microseconds()
+	metricQueueDuration.WithLabelValues(queueName(simReq)).Observe(queueDuration.Seconds())
+	metricSimDuration.WithLabelValues(queueName(simReq)).Observe(resp.SimDuration.Seconds())
+	endQueueSizeFastTrack, endQueueSizeHighPrio, endQueueSizeLowPrio := s.prioQueue.Len()
+	endItemQueueSize := s.prioQueue.ClassLen(queueName(simReq))
+
+	// Add additional profiling information about this request as part of the response headers
+	w.Header().Set("X-PrioLB-QueueDurationUs", fmt.Sprint(queueDurationUs))
+	w.Header().Set("X-PrioLB-SimDurationUs", fmt.Sprint(resp.SimDuration.Microseconds()))
+	w.Header().Set("X-PrioLB-TotalDurationUs", fmt.Sprint(time.Since(startTime).Microseconds()))
+	w.Header().Set("X-PrioLB-QueueSizeStart", fmt.Sprint(startItemQueueSize))
+	w.Header().Set("X-PrioLB-QueueSizeEnd", fmt.Sprint(endItemQueueSize))
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Payload)
+
+	log.Infow("Request completed",
+		"durationMs", time.Since(startTime).Milliseconds(), // full request duration in milliseconds
+		"durationUs", time.Since(startTime).Microseconds(), // full request duration in microseconds
+		"simDurationUs", resp.SimDuration.Microseconds(), // time only for simulation (proxying)
+		"queueDurationUs", queueDurationUs, // time until request was proxied (queue wait time)
+
+		"statusCode", resp.StatusCode,
+		"nodeURI", resp.NodeURI,
+		"requestTries", simReq.Tries,
+
+		"endQueueSize", s.prioQueue.NumRequests(),
+		"endQueueSizeFastTrack", endQueueSizeFastTrack,
+		"endQueueSizeHighPrio", endQueueSizeHighPrio,
+		"endQueueSizeLowPrio", endQueueSizeLowPrio,
+	)
+}
+
+// newSimRequest creates a SimRequest for the payload, with priority (see PriorityRules) and routing taken from the request
+func (s *Webserver) newSimRequest(req *http.Request, reqID string, payload []byte, log *zap.SugaredLogger) (*SimRequest, *zap.SugaredLogger) {
+	method := ParseMethod(payload)
+	isFastTrack := req.Header.Get("X-Fast-Track") == "true"
+	isHighPrio := req.Header.Get("high_prio") == "true" || req.Header.Get("X-High-Priority") == "true"
+	prioRule := s.priorityRules.Classify(method, req.URL.Path, req.Header)
+	if prioRule != nil {
+		isFastTrack = prioRule.Queue == QueueNameFastTrack
+		isHighPrio = prioRule.Queue == QueueNameHighPrio
+	}
+
+	simReq := NewSimRequest(req.Context(), reqID, payload, isHighPrio, isFastTrack)
+	if prioRule != nil {
+		simReq.QueueClass = prioRule.Queue
+		log = log.With("priorityRule", prioRule.Name)
+	}
+	simReq.RoutingKey = req.Header.Get("X-Routing-Key")
+	simReq.Deadline = requestDeadline(req.Header, simReq.CreatedAt)
+	simReq.ClientID = s.requestClientID(req)
+	if rule := s.routingRules.Match(method, req.Header, queueName(simReq)); rule != nil {
+		simReq.NodeLabels = rule.NodeLabels
+		log = log.With("routingRule", rule.Name)
+	}
+	if s.nodePool.BestHead() > 0 { // only route by block if node heads are known
+		simReq.MinBlockNumber = ParseRequiredBlockNumber(payload)
+	}
+	return simReq, log
+}
+
+// requestClientID returns the identity of the client: the ClientIDHeader if the request comes from a trusted proxy,
+// else the source IP. Requests with a known API key use its client name instead (see authenticate).
+func (s *Webserver) requestClientID(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if clientID := req.Header.Get(ClientIDHeader); ClientIDHeader != "" && clientID != "" && s.isTrustedProxy(host) {
+		return clientID
+	}
+	return host
+}
+
+func (s *Webserver) isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a comma-separated list of IPs and CIDRs, i.e. `10.0.0.1,10.1.0.0/16`
+func ParseTrustedProxies(s string) (proxies []*net.IPNet, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy: %s", entry)
+			} else if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, proxy, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Errorf("invalid trusted proxy: %s", entry)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// requestDeadline returns the deadline from the X-Deadline-Ms (milliseconds after the request) or X-Deadline
+// (unix timestamp in milliseconds) header, or the zero time if none is set
+func requestDeadline(header http.Header, createdAt time.Time) time.Time {
+	if ms, err := strconv.ParseInt(header.Get("X-Deadline-Ms"), 10, 64); err == nil && ms > 0 {
+		return createdAt.Add(time.Duration(ms) * time.Millisecond)
+	}
+	if ms, err := strconv.ParseInt(header.Get("X-Deadline"), 10, 64); err == nil && ms > 0 {
+		return time.UnixMilli(ms).UTC()
+	}
+	return time.Time{}
+}
+
+// waitForResponse waits for the final response to a queued request, and puts the request back into the
+// queue for retries (failing with ErrQueueFull if it can't be added again). Returns false if the client closed the connection.
+func (s *Webserver) waitForResponse(ctx context.Context, log *zap.SugaredLogger, simReq *SimRequest) (resp SimResponse, ok bool) {
 	for {
 		select {
 		case <-ctx.Done(): // if user closes connection, cancel the simreq
-			log.Infow("Client closed the connection prematurely", "err", ctx.Err(), "queueItems", s.prioQueue.NumRequests(), "payloadSize", len(body), "requestTries", simReq.Tries, "requestCancelled", simReq.Cancelled)
-			if ctx.Err() != nil {
-				simReq.Cancelled = true
-			}
-			return
-		case resp := <-simReq.ResponseC:
+			log.Infow("Client closed the connection prematurely", "err", ctx.Err(), "queueItems", s.prioQueue.NumRequests(), "payloadSize", len(simReq.Payload), "requestTries", simReq.Tries)
+			s.cancelRequest(simReq)
+			return resp, false
+		case resp = <-simReq.ResponseC:
 			if resp.Error != nil {
 				log.Infow("Request proxying failed", "err", resp.Error, "try", simReq.Tries, "shouldRetry", resp.ShouldRetry, "nodeURI", resp.NodeURI)
 				if simReq.Tries < RequestMaxTries && resp.ShouldRetry {
-					s.prioQueue.Push(simReq)
-					continue
+					metricNodeRetries.WithLabelValues(nodeMetricsLabel(resp.NodeURI)).Inc()
+					if s.prioQueue.Push(simReq) {
+						continue
+					}
+
+					// The queue filled up (or was closed) in the meantime, nothing would respond to the request anymore
+					log.Error("Couldn't add request for retry, queue is full")
+					metricRequestsRejected.WithLabelValues(RejectReasonQueueFull).Inc()
+					return SimResponse{Error: ErrQueueFull, StatusCode: http.StatusInternalServerError, NodeURI: resp.NodeURI}, true
 				}
+			}
+			return resp, true
+		}
+	}
+}
 
-				if resp.StatusCode == 0 {
-					resp.StatusCode = http.StatusInternalServerError
-				}
+// authenticate checks the API key of the request if API keys are required. Writes the error response and returns
+// false if the request is rejected. The quotas of the key are taken by the caller, per queued request (see APIKey.Acquire).
+func (s *Webserver) authenticate(w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, body []byte) (apiKey *APIKey, ok bool) {
+	if !APIKeysRequired {
+		return nil, true
+	}
 
-				if len(resp.Payload) > 0 {
-					w.WriteHeader(resp.StatusCode)
-					w.Write(resp.Payload)
-					return
-				}
+	apiKey = s.apiKeys.Get(requestAPIKey(req.Header))
+	if apiKey == nil {
+		log.Info("Request without valid API key")
+		metricRequestsRejected.WithLabelValues(RejectReasonUnauthorized).Inc()
+		writeRequestError(w, body, ErrUnauthorized, http.StatusUnauthorized)
+		return nil, false
+	}
+	return apiKey, true
+}
 
-				http.Error(w, strings.Trim(resp.Error.Error(), "\n"), resp.StatusCode)
-				return
-			}
+// admit returns whether a request may be queued, see AdmissionController
+func (s *Webserver) admit(simReq *SimRequest) bool {
+	if s.admission.Admit(s.prioQueue.ClassIndex(queueName(simReq))) {
+		return true
+	}
+	metricRequestsRejected.WithLabelValues(RejectReasonLoadShed).Inc()
+	return false
+}
 
-			if resp.StatusCode == 0 {
-				resp.StatusCode = http.StatusOK
+// cancelRequest cancels a request and removes it from the queue, or aborts the proxy request if it's in flight
+func (s *Webserver) cancelRequest(simReq *SimRequest) {
+	simReq.Cancel()
+	if s.prioQueue.Remove(simReq) {
+		updateQueueMetrics(s.prioQueue)
+	}
+}
+
+// handleBatchRequest queues each call of a JSON-RPC batch as separate request (so they can be processed
+// by different nodes), and responds with the responses in the order of the calls. Each call takes the
+// quotas of the API key, until its response is received.
+func (s *Webserver) handleBatchRequest(w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, body []byte, apiKey *APIKey) {
+	startTime := time.Now().UTC()
+	ctx := req.Context()
+	reqID := req.Header.Get("X-Request-ID")
+
+	var calls []json.RawMessage
+	if err := json.Unmarshal(body, &calls); err != nil {
+		writeJSONRPCError(w, http.StatusBadRequest, nil, JSONRPCErrParse, "parse error")
+		return
+	} else if len(calls) == 0 {
+		writeJSONRPCError(w, http.StatusBadRequest, nil, JSONRPCErrInvalidRequest, "empty batch")
+		return
+	} else if len(calls) > BatchMaxSize {
+		writeJSONRPCError(w, http.StatusBadRequest, nil, JSONRPCErrInvalidRequest, fmt.Sprintf("batch too large (max %d calls)", BatchMaxSize))
+		return
+	}
+
+	log = log.With("batchSize", len(calls), "payloadSize", len(body))
+	responses := make([]json.RawMessage, len(calls))
+	simReqs := make([]*SimRequest, len(calls))
+	notifications := make([]bool, len(calls)) // calls without id get no response
+	callLogs := make([]*zap.SugaredLogger, len(calls))
+
+	// abort cancels the queued calls and releases their API key quotas, if the batch is rejected
+	abort := func(queued []*SimRequest) {
+		for _, simReq := range queued {
+			if simReq == nil {
+				continue
 			}
+			s.cancelRequest(simReq)
+			if apiKey != nil {
+				apiKey.Release()
+			}
+		}
+	}
+
+	for i, call := range calls {
+		notifications[i] = IsNotification(call)
+
+		// Invalid calls are answered right away (invalid request objects also if they have no id)
+		if id, rpcErr := ValidateJSONRPCRequest(call, s.methodFilter); rpcErr != nil {
+			log.Infow("Invalid batch call", "batchIdx", i, "error", rpcErr)
+			metricRequestsRejected.WithLabelValues(rejectReasonForJSONRPCError(rpcErr)).Inc()
+			responses[i] = newJSONRPCErrorResponse(id, rpcErr.Code, rpcErr.Message)
+			notifications[i] = notifications[i] && rpcErr.Code != JSONRPCErrInvalidRequest
+			continue
+		}
 
-			queueDurationUs := resp.SimAt.Sub(startTime).Microseconds()
-			endQueueSizeFastTrack, endQueueSizeHighPrio, endQueueSizeLowPrio := s.prioQueue.Len()
-			endItemQueueSize := endQueueSizeLowPrio
-			if isFastTrack {
-				endItemQueueSize = endQueueSizeFastTrack
-			} else if isHighPrio {
-				endItemQueueSize = endQueueSizeHighPrio
+		simReq, callLog := s.newSimRequest(req, reqID, call, log.With("batchIdx", i))
+		callLogs[i] = callLog
+		if apiKey != nil {
+			simReq.ClientID = apiKey.Client
+			if !apiKey.AllowsQueue(queueName(simReq)) {
+				callLog.Infow("Priority not allowed for API key", "queueClass", queueName(simReq))
+				metricRequestsRejected.WithLabelValues(RejectReasonQueueNotAllowed).Inc()
+				responses[i] = newJSONRPCErrorResponse(ParseID(call), JSONRPCErrQueueNotAllowed, ErrQueueNotAllowed.Error())
+				continue
 			}
+		}
 
-			// Add additional profiling information about this request as part of the response headers
-			w.Header().Set("X-PrioLB-QueueDurationUs", fmt.Sprint(queueDurationUs))
-			w.Header().Set("X-PrioLB-SimDurationUs", fmt.Sprint(resp.SimDuration.Microseconds()))
-			w.Header().Set("X-PrioLB-TotalDurationUs", fmt.Sprint(time.Since(startTime).Microseconds()))
-			w.Header().Set("X-PrioLB-QueueSizeStart", fmt.Sprint(startItemQueueSize))
-			w.Header().Set("X-PrioLB-QueueSizeEnd", fmt.Sprint(endItemQueueSize))
+		if !s.rateLimiter.Allow(simReq.ClientID, queueName(simReq)) {
+			callLog.Infow("Rate limit exceeded", "clientID", simReq.ClientID, "queueClass", queueName(simReq))
+			metricRequestsRejected.WithLabelValues(RejectReasonRateLimited).Inc()
+			responses[i] = newJSONRPCErrorResponse(ParseID(call), JSONRPCErrRateLimited, ErrRateLimited.Error())
+			continue
+		}
 
-			// Send the response
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(resp.StatusCode)
-			w.Write(resp.Payload)
+		if apiKey != nil && !apiKey.Acquire() {
+			callLog.Info("API key quota exceeded")
+			metricRequestsRejected.WithLabelValues(RejectReasonQuotaExceeded).Inc()
+			responses[i] = newJSONRPCErrorResponse(ParseID(call), JSONRPCErrQuotaExceeded, ErrQuotaExceeded.Error())
+			continue
+		}
 
-			log.Infow("Request completed",
-				"durationMs", time.Since(startTime).Milliseconds(), // full request duration in milliseconds
-				"durationUs", time.Since(startTime).Microseconds(), // full request duration in microseconds
-				"simDurationUs", resp.SimDuration.Microseconds(), // time only for simulation (proxying)
-				"queueDurationUs", queueDurationUs, // time until request was proxied (queue wait time)
-
-				"statusCode", resp.StatusCode,
-				"nodeURI", resp.NodeURI,
-				"requestTries", simReq.Tries,
-
-				"endQueueSize", s.prioQueue.NumRequests(),
-				"endQueueSizeFastTrack", endQueueSizeFastTrack,
-				"endQueueSizeHighPrio", endQueueSizeHighPrio,
-				"endQueueSizeLowPrio", endQueueSizeLowPrio,
-			)
+		simReqs[i] = simReq
+		if !s.admit(simReqs[i]) {
+			callLog.Infow("Batch request shed, queue delay above target", "queueClass", queueName(simReqs[i]))
+			abort(simReqs[:i+1])
+			writeOverloadedError(w, nil, s.admission.RetryAfter())
+			return
+		}
+		if !s.prioQueue.Push(simReqs[i]) {
+			log.Error("Couldn't add batch request, queue is full")
+			metricRequestsRejected.WithLabelValues(RejectReasonQueueFull).Inc()
+			abort(simReqs[:i+1])
+			writeRequestError(w, nil, ErrQueueFull, http.StatusInternalServerError)
 			return
 		}
 	}
+	updateQueueMetrics(s.prioQueue)
+	log.Infow("Batch request added to queue")
+
+	// Wait for the responses of all calls
+	var wg sync.WaitGroup
+	for i, simReq := range simReqs {
+		if simReq == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, simReq *SimRequest) {
+			defer wg.Done()
+			if apiKey != nil {
+				defer apiKey.Release()
+			}
+			resp, ok := s.waitForResponse(ctx, callLogs[i], simReq)
+			if !ok {
+				return
+			}
+			if resp.Error == nil {
+				metricQueueDuration.WithLabelValues(queueName(simReq)).Observe(resp.SimAt.Sub(startTime).Seconds())
+				metricSimDuration.WithLabelValues(queueName(simReq)).Observe(resp.SimDuration.Seconds())
+			}
+			responses[i] = batchCallResponse(calls[i], resp)
+		}(i, simReq)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Notifications get no response, and if all calls are notifications there's no body
+	batchResponses := make([]json.RawMessage, 0, len(calls))
+	for i, resp := range responses {
+		if !notifications[i] {
+			batchResponses = append(batchResponses, resp)
+		}
+	}
+
+	w.Header().Set("X-PrioLB-TotalDurationUs", fmt.Sprint(time.Since(startTime).Microseconds()))
+	if len(batchResponses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		log.Infow("Batch request of notifications completed", "durationMs", time.Since(startTime).Milliseconds())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(batchResponses); err != nil {
+		log.Errorw("Couldn't send batch response", "error", err)
+		return
+	}
+	log.Infow("Batch request completed", "durationMs", time.Since(startTime).Milliseconds())
+}
+
+// batchCallResponse returns the JSON-RPC response for one call of a batch. Errors without a JSON-RPC
+// response from the node are converted into a JSON-RPC error with the id of the call.
+func batchCallResponse(call json.RawMessage, resp SimResponse) json.RawMessage {
+	if isJSONRPCResponse(resp.Payload) {
+		return resp.Payload
+	}
+
+	if resp.Error == nil {
+		return newJSONRPCErrorResponse(ParseID(call), JSONRPCErrInternal, "invalid response from node")
+	}
+	code, _ := jsonRPCErrorCode(resp.Error)
+	return newJSONRPCErrorResponse(ParseID(call), code, strings.Trim(resp.Error.Error(), "\n"))
+}
+
+// validateRequest validates the JSON-RPC request, or each call of a batch request
+func (s *Webserver) validateRequest(body []byte) (id interface{}, rpcErr *JSONRPCError) {
+	if !isBatchPayload(body) {
+		return ValidateJSONRPCRequest(body, s.methodFilter)
+	}
+
+	var calls []json.RawMessage
+	if err := json.Unmarshal(body, &calls); err != nil {
+		return nil, &JSONRPCError{Code: JSONRPCErrParse, Message: "parse error"}
+	} else if len(calls) == 0 {
+		return nil, &JSONRPCError{Code: JSONRPCErrInvalidRequest, Message: "empty batch"}
+	}
+	for _, call := range calls {
+		if id, rpcErr = ValidateJSONRPCRequest(call, s.methodFilter); rpcErr != nil {
+			return id, rpcErr
+		}
+	}
+	return nil, nil
+}
+
+// rejectReasonForJSONRPCError returns the metrics label for a request rejected by the validation
+func rejectReasonForJSONRPCError(rpcErr *JSONRPCError) string {
+	if rpcErr.Code == JSONRPCErrMethodNotFound {
+		return RejectReasonMethodNotAllowed
+	}
+	return RejectReasonInvalidRequest
+}
+
+// newJSONRPCErrorResponse returns an encoded JSON-RPC error response
+func newJSONRPCErrorResponse(id interface{}, code int, message string) json.RawMessage {
+	resp, _ := json.Marshal(JSONRPCResponse{
+		ID:      id,
+		Error:   &JSONRPCError{Code: code, Message: message},
+		Version: "2.0",
+	})
+	return resp
+}
+
+// writeRequestError responds to a request which failed in the balancer. With JSONRPC_ERRORS=1 the response
+// is a JSON-RPC error with the id of the request, otherwise a plain-text HTTP error with statusCode.
+func writeRequestError(w http.ResponseWriter, payload []byte, err error, statusCode int) {
+	if JSONRPCErrors {
+		code, rpcStatusCode := jsonRPCErrorCode(err)
+		writeJSONRPCError(w, rpcStatusCode, ParseID(payload), code, strings.Trim(err.Error(), "\n"))
+		return
+	}
+	http.Error(w, strings.Trim(err.Error(), "\n"), statusCode)
+}
+
+// writeOverloadedError sends the error for a shed request, with the Retry-After header
+func writeOverloadedError(w http.ResponseWriter, payload []byte, retryAfterSec int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSec))
+	writeRequestError(w, payload, ErrOverloaded, http.StatusServiceUnavailable)
+}
+
+// writeJSONRPCError sends a JSON-RPC error response
+func writeJSONRPCError(w http.ResponseWriter, statusCode int, id interface{}, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(newJSONRPCErrorResponse(id, code, message))
 }
 
 type NodeURIPayload struct {
 	URI string `json:"uri"`
 }
 
+// Node actions for PATCH /nodes
+const (
+	NodeActionDrain   = "drain"
+	NodeActionUndrain = "undrain"
+	NodeActionResize  = "resize"
+)
+
+type NodeActionPayload struct {
+	URI        string `json:"uri"`
+	Action     string `json:"action"`
+	TimeoutSec int    `json:"timeoutSec,omitempty"` // drain: how long to wait for requests in flight, 0 means NODE_DRAIN_TIMEOUT
+	Remove     bool   `json:"remove,omitempty"`     // drain: remove the node from the pool once drained
+	Workers    int32  `json:"workers,omitempty"`    // resize: new number of workers
+}
+
 func (s *Webserver) HandleNodesRequest(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "GET" {
+		// `?details=true` returns the full node state (i.e. health), otherwise just the list of URIs
+		var resp interface{} = s.nodePool.NodeUris()
+		if req.URL.Query().Get("details") == "true" {
+			resp = s.nodePool.NodeInfos()
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(s.nodePool.NodeUris()); err != nil {
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 	} else if req.Method == "POST" {
-		var payload NodeURIPayload
-		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, err := s.nodeConfigUpdate(body)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if err := s.nodePool.AddNode(payload.URI); err != nil {
+		if err := s.nodePool.AddNodeFrom(payload, nodeChangeOrigin(req)); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		w.WriteHeader(http.StatusOK)
 
+	} else if req.Method == "PATCH" {
+		var payload NodeActionPayload
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch payload.Action {
+		case NodeActionDrain:
+			timeout := NodeDrainTimeout
+			if payload.TimeoutSec > 0 {
+				timeout = time.Duration(payload.TimeoutSec) * time.Second
+			}
+			err = s.nodePool.DrainNodeFrom(payload.URI, timeout, payload.Remove, nodeChangeOrigin(req))
+		case NodeActionUndrain:
+			err = s.nodePool.UndrainNodeFrom(payload.URI, nodeChangeOrigin(req))
+		case NodeActionResize:
+			err = s.nodePool.SetNodeWorkersFrom(payload.URI, payload.Workers, nodeChangeOrigin(req))
+		default:
+			http.Error(w, fmt.Sprintf("unknown action: %s", payload.Action), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Respond with the current state of the node, to follow the progress use GET /nodes?details=true
+		info, _ := s.nodePool.NodeInfo(payload.URI)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 	} else if req.Method == "DELETE" {
 		var payload NodeURIPayload
 		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
@@ -239,7 +790,7 @@ func (s *Webserver) HandleNodesRequest(w http.ResponseWriter, req *http.Request)
 			return
 		}
 
-		wasRemoved, err := s.nodePool.DelNode(payload.URI)
+		wasRemoved, err := s.nodePool.DelNodeFrom(payload.URI, nodeChangeOrigin(req))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -254,6 +805,134 @@ func (s *Webserver) HandleNodesRequest(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+type APIKeyPayload struct {
+	Key string `json:"key"`
+}
+
+// nodeConfigUpdate returns the node config for a POST /nodes payload. If the node exists already, only the
+// fields set in the payload are changed (i.e. a payload with just the URI doesn't reset the labels or weight).
+func (s *Webserver) nodeConfigUpdate(body []byte) (config NodeConfig, err error) {
+	if err = json.Unmarshal(body, &config); err != nil {
+		return config, err
+	}
+	current, found := s.nodePool.NodeConfig(config.URI)
+	if !found {
+		return config, nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(body, &fields); err != nil {
+		return config, err
+	}
+	if _, found := fields["labels"]; found {
+		current.Labels = nil // replace the labels instead of merging them
+	}
+	err = json.Unmarshal(body, &current)
+	return current, err
+}
+
+// nodeChangeOrigin returns the origin of a node pool change through the admin API, for the audit trail
+func nodeChangeOrigin(req *http.Request) NodeChangeOrigin {
+	return NodeChangeOrigin{Actor: AdminActor(req.Context()), Source: NodeChangeSourceAPI}
+}
+
+// NodeEventsResponse is a page of the node pool audit trail. Next is the `before` parameter for the next page.
+type NodeEventsResponse struct {
+	Events []NodeEvent `json:"events"`
+	Next   string      `json:"next,omitempty"`
+}
+
+// HandleNodeEventsRequest pages through the node pool audit trail, newest first: `?limit=` events (default 100,
+// up to 1000) older than the event ID in `?before=`
+func (s *Webserver) HandleNodeEventsRequest(w http.ResponseWriter, req *http.Request) {
+	limit := int64(100)
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := s.nodePool.NodeEvents(req.URL.Query().Get("before"), limit)
+	if err == ErrNoNodeEvents {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := NodeEventsResponse{Events: events}
+	if int64(len(events)) == limit {
+		resp.Next = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Webserver) HandleAPIKeysRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		// Only the first characters of the keys are shown
+		configs := s.apiKeys.Configs()
+		for i := range configs {
+			configs[i].Key = maskAPIKey(configs[i].Key)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(configs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	} else if req.Method == "POST" {
+		var payload APIKeyConfig
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.apiKeys.AddKey(payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	} else if req.Method == "DELETE" {
+		var payload APIKeyPayload
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		wasRemoved, err := s.apiKeys.DelKey(payload.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !wasRemoved {
+			http.Error(w, "API key not found", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// maskAPIKey returns the first 4 characters of an API key, to identify it without revealing it
+func maskAPIKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
+
 // HandleTestLogLevels is used for testing error logging, to verify for operations. Is opt-in with `ENABLE_ERROR_TEST_API=1`
 func (s *Webserver) HandleTestLogLevels(w http.ResponseWriter, req *http.Request) {
 	s.log.Debug("debug")
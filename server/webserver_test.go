@@ -7,12 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -59,6 +62,18 @@ func TestWebserver(t *testing.T) {
 	require.Nil(t, err, err)
 	require.Equal(t, 1, len(nodes))
 
+	// Get the node details
+	getNodesReq, _ = http.NewRequest("GET", "/nodes?details=true", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, getNodesReq)
+	require.Equal(t, http.StatusOK, rr.Code)
+	nodeInfos := []NodeInfo{}
+	err = json.Unmarshal(rr.Body.Bytes(), &nodeInfos)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(nodeInfos))
+	require.Equal(t, mockNodeServer.URL, nodeInfos[0].URI)
+	require.True(t, nodeInfos[0].Healthy)
+
 	// Noop an error on adding a node twice
 	addNodeReq, _ = http.NewRequest("POST", "/nodes", bytes.NewBufferString(addNodePayload))
 	rr = httptest.NewRecorder()
@@ -113,7 +128,8 @@ func TestWebserverSim(t *testing.T) {
 			if job == nil {
 				return
 			}
-			nodePool.JobC <- job
+			err := nodePool.Dispatch(job, time.Second)
+			assert.Nil(t, err, err)
 		}
 	}()
 
@@ -161,3 +177,576 @@ func TestWebserverSim(t *testing.T) {
 	require.True(t, tX.Seconds() < 1, "should have been cancelled")
 	// Here no further requests can be made!
 }
+
+func TestWebserverCancel(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL))
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	serveCancelled := func(cancelC chan bool) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`))
+		doneC := make(chan bool)
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			close(doneC)
+		}()
+		<-cancelC
+		cancel()
+		<-doneC
+	}
+
+	// Cancelled request is removed from the queue right away
+	cancelC := make(chan bool)
+	go func() {
+		assert.Eventually(t, func() bool { return prioQueue.NumRequests() == 1 }, time.Second, 5*time.Millisecond)
+		close(cancelC)
+	}()
+	serveCancelled(cancelC)
+	require.Equal(t, 0, prioQueue.NumRequests())
+
+	// Cancelling a request in flight aborts the proxy request
+	abortedC := make(chan bool)
+	cancelC = make(chan bool)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body) // lets the server notice when the connection is closed
+		close(cancelC)
+		<-req.Context().Done()
+		close(abortedC)
+	}
+	go func() {
+		job := prioQueue.Pop()
+		err := nodePool.Dispatch(job, time.Second)
+		assert.Nil(t, err, err)
+	}()
+	serveCancelled(cancelC)
+	select {
+	case <-abortedC:
+	case <-time.After(time.Second):
+		t.Fatal("proxy request was not aborted")
+	}
+}
+
+func TestWebserverNodeConfig(t *testing.T) {
+	resetTestRedis()
+
+	nodePool := NewNodePool(testLog, redisTestState, 1)
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), nodePool)
+	handler := http.HandlerFunc(webserver.HandleNodesRequest)
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	// Add a node with a full descriptor, and workers from the legacy query param
+	addNodePayload := fmt.Sprintf(`{"uri":"%s?_workers=3","weight":5,"labels":{"tee":"sgx"},"maxPayloadSize":1000,"notes":"foo"}`, mockNodeServer.URL)
+	addNodeReq, _ := http.NewRequest("POST", "/nodes", bytes.NewBufferString(addNodePayload))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, addNodeReq)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	getNodesReq, _ := http.NewRequest("GET", "/nodes?details=true", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, getNodesReq)
+	nodeInfos := []NodeInfo{}
+	err := json.Unmarshal(rr.Body.Bytes(), &nodeInfos)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(nodeInfos))
+	require.Equal(t, int32(3), nodeInfos[0].NumWorkers)
+	require.Equal(t, 5, nodeInfos[0].Weight)
+	require.Equal(t, "sgx", nodeInfos[0].Labels["tee"])
+	require.Equal(t, 1000, nodeInfos[0].MaxPayloadSize)
+	require.True(t, nodeInfos[0].IsEnabled())
+	require.Equal(t, "foo", nodeInfos[0].Notes)
+
+	// Update the node, disabling it
+	addNodePayload = fmt.Sprintf(`{"uri":"%s?_workers=3","weight":2,"enabled":false}`, mockNodeServer.URL)
+	addNodeReq, _ = http.NewRequest("POST", "/nodes", bytes.NewBufferString(addNodePayload))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, addNodeReq)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, 1, len(nodePool.nodes))
+	require.False(t, nodePool.nodes[0].IsAvailable())
+	require.Equal(t, 0, nodePool.NumAvailableNodes())
+
+	// check redis
+	nodesFromRedis, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(nodesFromRedis))
+	require.Equal(t, 2, nodesFromRedis[0].Weight)
+	require.False(t, nodesFromRedis[0].IsEnabled())
+
+	// Resize the workers
+	resizeReq, _ := http.NewRequest("PATCH", "/nodes", bytes.NewBufferString(fmt.Sprintf(`{"uri":"%s?_workers=3","action":"resize","workers":5}`, mockNodeServer.URL)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, resizeReq)
+	require.Equal(t, http.StatusOK, rr.Code)
+	nodeInfo := NodeInfo{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &nodeInfo))
+	require.Equal(t, int32(5), nodeInfo.NumWorkers)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&nodePool.nodes[0].curWorkers) == 5 }, time.Second, 5*time.Millisecond)
+
+	nodesFromRedis, err = redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, int32(5), nodesFromRedis[0].Workers)
+
+	resizeReq, _ = http.NewRequest("PATCH", "/nodes", bytes.NewBufferString(fmt.Sprintf(`{"uri":"%s?_workers=3","action":"resize","workers":0}`, mockNodeServer.URL)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, resizeReq)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestWebserverNodeDrain(t *testing.T) {
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), nodePool)
+	handler := http.HandlerFunc(webserver.HandleNodesRequest)
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL))
+
+	// Unknown action and unknown node
+	for _, payload := range []string{
+		fmt.Sprintf(`{"uri":"%s","action":"foo"}`, mockNodeServer.URL),
+		`{"uri":"http://foo","action":"drain"}`,
+	} {
+		req, _ := http.NewRequest("PATCH", "/nodes", bytes.NewBufferString(payload))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusBadRequest, rr.Code, payload)
+	}
+
+	// Drain
+	req, _ := http.NewRequest("PATCH", "/nodes", bytes.NewBufferString(fmt.Sprintf(`{"uri":"%s","action":"drain"}`, mockNodeServer.URL)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	info := NodeInfo{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	require.True(t, info.Draining)
+	require.Equal(t, 0, nodePool.NumAvailableNodes())
+
+	// Undrain
+	req, _ = http.NewRequest("PATCH", "/nodes", bytes.NewBufferString(fmt.Sprintf(`{"uri":"%s","action":"undrain"}`, mockNodeServer.URL)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	require.False(t, info.Draining)
+	require.Equal(t, 1, nodePool.NumAvailableNodes())
+}
+
+func TestWebserverBatch(t *testing.T) {
+	origBatchRequests, origBatchMaxSize := BatchRequests, BatchMaxSize
+	BatchRequests, BatchMaxSize = true, 4
+	defer func() { BatchRequests, BatchMaxSize = origBatchRequests, origBatchMaxSize }()
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	nodePool := NewNodePool(testLog, nil, 2)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL))
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	// Pump jobs from prioQueue to nodepool
+	go func() {
+		for {
+			job := prioQueue.Pop()
+			if job == nil {
+				return
+			}
+			err := nodePool.Dispatch(job, time.Second)
+			assert.Nil(t, err, err)
+		}
+	}()
+	defer prioQueue.Close()
+
+	// Each call gets its own response, in order and with matching ids (denied methods are answered without queueing)
+	reqPayload := `[{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}, {"jsonrpc":"2.0","id":"a","method":"net_version","params":[]}, {"jsonrpc":"2.0","id":3,"method":"foo_bar","params":[]}, {"jsonrpc":"2.0","id":4,"method":"admin_addPeer","params":[]}]`
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(reqPayload))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	responses := []JSONRPCResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &responses))
+	require.Equal(t, 4, len(responses))
+	require.Equal(t, float64(1), responses[0].ID)
+	require.Equal(t, `"cool"`, string(responses[0].Result))
+	require.Equal(t, "a", responses[1].ID)
+	require.Equal(t, `"1"`, string(responses[1].Result))
+	require.Equal(t, float64(3), responses[2].ID)
+	require.NotNil(t, responses[2].Error)
+	require.Equal(t, float64(4), responses[3].ID)
+	require.Equal(t, JSONRPCErrMethodNotFound, responses[3].Error.Code)
+
+	// Notifications are processed, but get no response
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString(`[{"jsonrpc":"2.0","method":"eth_callBundle","params":[]}, {"jsonrpc":"2.0","id":2,"method":"net_version","params":[]}, {"jsonrpc":"2.0","method":"admin_addPeer","params":[]}]`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	responses = []JSONRPCResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &responses))
+	require.Equal(t, 1, len(responses))
+	require.Equal(t, float64(2), responses[0].ID)
+
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString(`[{"jsonrpc":"2.0","method":"eth_callBundle","params":[]}]`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Equal(t, 0, rr.Body.Len())
+
+	// Node errors without JSON-RPC response are converted into JSON-RPC errors
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", 479)
+	}
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString(`[{"jsonrpc":"2.0","id":7,"method":"eth_callBundle","params":[]}]`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &responses))
+	require.Equal(t, 1, len(responses))
+	require.Equal(t, float64(7), responses[0].ID)
+	require.Equal(t, JSONRPCErrInternal, responses[0].Error.Code)
+	require.Contains(t, responses[0].Error.Message, "479")
+
+	// Empty and too large batches are rejected
+	for _, payload := range []string{`[]`, `[{"id":1},{"id":2},{"id":3},{"id":4},{"id":5}]`} {
+		req, _ = http.NewRequest("POST", "/", bytes.NewBufferString(payload))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		resp := JSONRPCResponse{}
+		require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		require.Equal(t, JSONRPCErrInvalidRequest, resp.Error.Code)
+	}
+}
+
+func TestWebserverValidation(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	testCases := []struct {
+		payload      string
+		expectedID   interface{}
+		expectedCode int
+	}{
+		{`foo`, nil, JSONRPCErrParse},
+		{`{"jsonrpc":"2.0","id":1,"params":[]}`, float64(1), JSONRPCErrInvalidRequest},
+		{`{"jsonrpc":"2.0","id":2,"method":"admin_addPeer","params":[]}`, float64(2), JSONRPCErrMethodNotFound},
+		{`[{"jsonrpc":"2.0","id":3,"method":"eth_callBundle","params":[]},{"jsonrpc":"2.0","id":4,"method":"personal_sign","params":[]}]`, float64(4), JSONRPCErrMethodNotFound},
+	}
+
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(testCase.payload))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusBadRequest, rr.Code, testCase.payload)
+		resp := JSONRPCResponse{}
+		require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &resp), testCase.payload)
+		require.Equal(t, testCase.expectedID, resp.ID, testCase.payload)
+		require.Equal(t, testCase.expectedCode, resp.Error.Code, testCase.payload)
+	}
+
+	// Nothing was queued
+	require.Equal(t, 0, prioQueue.NumRequests())
+}
+
+func TestWebserverJSONRPCErrors(t *testing.T) {
+	origJSONRPCErrors := JSONRPCErrors
+	JSONRPCErrors = true
+	defer func() { JSONRPCErrors = origJSONRPCErrors }()
+
+	prioQueue := NewPrioQueue(0, 0, 1, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	// Queue full -> 429
+	require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "1", []byte("foo"), false, false)))
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"jsonrpc":"2.0","id":"abc","method":"eth_callBundle","params":[]}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	resp := JSONRPCResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Equal(t, "abc", resp.ID)
+	require.Equal(t, JSONRPCErrQueueFull, resp.Error.Code)
+	require.Equal(t, ErrQueueFull.Error(), resp.Error.Message)
+}
+
+func TestWebserverRetryQueueFull(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 1, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+
+	// The request was popped by a node, and another request took its place in the queue meanwhile
+	simReq := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "2", []byte("foo"), false, false)))
+	simReq.ResponseC <- SimResponse{Error: ErrNodeTimeout, ShouldRetry: true, Payload: []byte("node error")}
+
+	// The retry can't be queued, the request fails instead of waiting forever
+	resp, ok := webserver.waitForResponse(context.Background(), testLog, simReq)
+	require.True(t, ok)
+	require.Equal(t, ErrQueueFull, resp.Error)
+	require.Equal(t, 0, len(resp.Payload))
+	require.Equal(t, 1, prioQueue.NumRequests())
+}
+
+func TestRequestClientID(t *testing.T) {
+	defer func(header string) { ClientIDHeader = header }(ClientIDHeader)
+	ClientIDHeader = "X-Client-ID"
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), NewNodePool(testLog, nil, 1))
+	var err error
+	webserver.trustedProxies, err = ParseTrustedProxies("10.0.0.1, 10.1.0.0/16")
+	require.Nil(t, err, err)
+
+	// The header is only used from trusted proxies, and the API key is never used as client ID
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "10.2.0.1:4242"
+	req.Header.Set("X-API-Key", "foo")
+	require.Equal(t, "10.2.0.1", webserver.requestClientID(req))
+	req.Header.Set(ClientIDHeader, "builder")
+	require.Equal(t, "10.2.0.1", webserver.requestClientID(req))
+	req.RemoteAddr = "10.1.2.3:4242"
+	require.Equal(t, "builder", webserver.requestClientID(req))
+	req.RemoteAddr = "10.0.0.1:4242"
+	require.Equal(t, "builder", webserver.requestClientID(req))
+
+	_, err = ParseTrustedProxies("10.0.0.1,foo")
+	require.NotNil(t, err)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	createdAt := time.Now().UTC()
+	require.True(t, requestDeadline(http.Header{}, createdAt).IsZero())
+	require.True(t, requestDeadline(http.Header{"X-Deadline-Ms": {"foo"}}, createdAt).IsZero())
+	require.Equal(t, createdAt.Add(500*time.Millisecond), requestDeadline(http.Header{"X-Deadline-Ms": {"500"}}, createdAt))
+	require.Equal(t, time.UnixMilli(1700000000123).UTC(), requestDeadline(http.Header{"X-Deadline": {"1700000000123"}}, createdAt))
+}
+
+func TestWebserverLoadShedding(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	webserver.admission = NewAdmissionController(10*time.Millisecond, 10*time.Millisecond, 3, prioQueue.NumRequests)
+	webserver.admission.sheddingLevel = 1
+
+	// Low-prio request is shed
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload))
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "1", rr.Header().Get("Retry-After"))
+	require.Equal(t, 0, prioQueue.NumRequests())
+
+	// High-prio request is queued
+	ctx, cancel := context.WithCancel(context.Background())
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload)).WithContext(ctx)
+	req.Header.Set("X-High-Priority", "true")
+	go func() {
+		assert.Eventually(t, func() bool { return prioQueue.NumRequests() == 1 }, time.Second, 5*time.Millisecond)
+		cancel()
+	}()
+	webserver.HandleQueueRequest(httptest.NewRecorder(), req)
+}
+
+func TestWebserverRateLimit(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	webserver.rateLimiter = NewClientRateLimiter(testLog, map[string]float64{QueueNameLowPrio: 1}, nil)
+	webserver.rateLimiter.buckets[QueueNameLowPrio+":10.0.0.1"] = newTokenBucket(1, 0)
+
+	// Client without tokens left is rejected
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload))
+	req.RemoteAddr = "10.0.0.1:4242"
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "1", rr.Header().Get("Retry-After"))
+	require.Equal(t, 0, prioQueue.NumRequests())
+
+	// Other clients are queued
+	ctx, cancel := context.WithCancel(context.Background())
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload)).WithContext(ctx)
+	req.RemoteAddr = "10.0.0.2:4242"
+	go func() {
+		assert.Eventually(t, func() bool { return prioQueue.NumRequests() == 1 }, time.Second, 5*time.Millisecond)
+		cancel()
+	}()
+	webserver.HandleQueueRequest(httptest.NewRecorder(), req)
+}
+
+func TestNodeConfigUpdate(t *testing.T) {
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), nodePool)
+	handler := http.HandlerFunc(webserver.HandleNodesRequest)
+
+	postNode := func(payload string) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/nodes", bytes.NewBufferString(payload)))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	disabled := false
+	postNode(fmt.Sprintf(`{"uri":"%s","weight":3,"labels":{"region":"eu","type":"archive"},"enabled":false}`, mockNodeServer.URL))
+
+	// Only the fields in the payload are changed
+	postNode(fmt.Sprintf(`{"uri":"%s"}`, mockNodeServer.URL))
+	postNode(fmt.Sprintf(`{"uri":"%s","notes":"geth"}`, mockNodeServer.URL))
+	config, _ := nodePool.NodeConfig(mockNodeServer.URL)
+	require.Equal(t, NodeConfig{URI: mockNodeServer.URL, Weight: 3, Labels: map[string]string{"region": "eu", "type": "archive"}, Enabled: &disabled, Notes: "geth"}, config)
+
+	// Labels are replaced, not merged
+	postNode(fmt.Sprintf(`{"uri":"%s","labels":{"region":"us"}}`, mockNodeServer.URL))
+	config, _ = nodePool.NodeConfig(mockNodeServer.URL)
+	require.Equal(t, map[string]string{"region": "us"}, config.Labels)
+}
+
+func TestWebserverNodeEvents(t *testing.T) {
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), NewNodePool(testLog, nil, 1))
+	handler := http.HandlerFunc(webserver.HandleNodeEventsRequest)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes/events", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	resetTestRedis()
+	nodePool := NewNodePool(testLog, redisTestState, 1)
+	for i := 0; i < 3; i++ {
+		nodePool.recordEvent(NodeEventAdd, fmt.Sprintf("http://node%d", i), NodeChangeOrigin{Source: NodeChangeSourceAPI}, nil, nil)
+	}
+	webserver = NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false), nodePool)
+	handler = http.HandlerFunc(webserver.HandleNodeEventsRequest)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes/events?limit=0", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Page through the events, newest first
+	resp := NodeEventsResponse{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes/events?limit=2", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Equal(t, 2, len(resp.Events))
+	require.Equal(t, "http://node2", resp.Events[0].URI)
+	require.Equal(t, resp.Events[1].ID, resp.Next)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/nodes/events?limit=2&before="+resp.Next, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	resp = NodeEventsResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Equal(t, 1, len(resp.Events))
+	require.Equal(t, "http://node0", resp.Events[0].URI)
+	require.Equal(t, "", resp.Next)
+}
+
+func TestWebserverAPIKeys(t *testing.T) {
+	defer func(required bool) { APIKeysRequired = required }(APIKeysRequired)
+	APIKeysRequired = true
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	handler := http.HandlerFunc(webserver.HandleAPIKeysRequest)
+
+	// Add and list keys
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"key":"builder-key","client":"builder","queues":["high-prio"],"maxConcurrent":1}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/apikeys", nil))
+	require.Equal(t, `[{"key":"buil****","client":"builder","queues":["high-prio"],"maxConcurrent":1}]`+"\n", rr.Body.String())
+
+	sendRequest := func(apiKey string, isFastTrack bool) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("X-High-Priority", "true")
+		if isFastTrack {
+			req.Header.Set("X-Fast-Track", "true")
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, sendRequest("", false))
+	require.Equal(t, http.StatusUnauthorized, sendRequest("foo", false))
+	require.Equal(t, http.StatusForbidden, sendRequest("builder-key", true))
+
+	// Concurrency quota: the first request is queued, the second one rejected
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(testRequestPayload)).WithContext(ctx)
+	req.Header.Set("X-API-Key", "builder-key")
+	req.Header.Set("X-High-Priority", "true")
+	doneC := make(chan bool)
+	go func() {
+		webserver.HandleQueueRequest(httptest.NewRecorder(), req)
+		close(doneC)
+	}()
+	require.Eventually(t, func() bool { return prioQueue.NumRequests() == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, http.StatusTooManyRequests, sendRequest("builder-key", false))
+	cancel()
+	<-doneC
+
+	// Each call of a batch takes the quota: only one of the calls is queued, until it's completed
+	defer func(batchRequests bool) { BatchRequests = batchRequests }(BatchRequests)
+	BatchRequests = true
+	apiKey := webserver.apiKeys.Get("builder-key")
+	ctx, cancel = context.WithCancel(context.Background())
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(`[{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_callBundle","params":[]}]`)).WithContext(ctx)
+	req.Header.Set("X-API-Key", "builder-key")
+	req.Header.Set("X-High-Priority", "true")
+	doneC = make(chan bool)
+	go func() {
+		webserver.HandleQueueRequest(httptest.NewRecorder(), req)
+		close(doneC)
+	}()
+	require.Eventually(t, func() bool { return prioQueue.NumRequests() == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(1), apiKey.inFlight.Load())
+	cancel()
+	<-doneC
+	require.Equal(t, 0, prioQueue.NumRequests())
+	require.Equal(t, int32(0), apiKey.inFlight.Load())
+
+	// Delete key
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("DELETE", "/apikeys", bytes.NewBufferString(`{"key":"builder-key"}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, http.StatusUnauthorized, sendRequest("builder-key", false))
+}
+
+func TestJSONRPCErrorCode(t *testing.T) {
+	testCases := []struct {
+		err                error
+		expectedCode       int
+		expectedStatusCode int
+	}{
+		{ErrQueueFull, JSONRPCErrQueueFull, http.StatusTooManyRequests},
+		{ErrRequestTimeout, JSONRPCErrRequestTimeout, http.StatusGatewayTimeout},
+		{ErrOverloaded, JSONRPCErrOverloaded, http.StatusServiceUnavailable},
+		{ErrUnauthorized, JSONRPCErrUnauthorized, http.StatusUnauthorized},
+		{ErrQueueNotAllowed, JSONRPCErrQueueNotAllowed, http.StatusForbidden},
+		{ErrQuotaExceeded, JSONRPCErrQuotaExceeded, http.StatusTooManyRequests},
+		{ErrRateLimited, JSONRPCErrRateLimited, http.StatusTooManyRequests},
+		{ErrNodeTimeout, JSONRPCErrNodeTimeout, http.StatusGatewayTimeout},
+		{ErrNoNodesAvailable, JSONRPCErrNoNodesAvailable, http.StatusServiceUnavailable},
+		{ErrBlockNotAvailable, JSONRPCErrBlockNotAvailable, http.StatusServiceUnavailable},
+		{errors.New("proxying request failed"), JSONRPCErrInternal, http.StatusBadGateway},
+	}
+	for _, testCase := range testCases {
+		code, statusCode := jsonRPCErrorCode(testCase.err)
+		require.Equal(t, testCase.expectedCode, code, testCase.err.Error())
+		require.Equal(t, testCase.expectedStatusCode, statusCode, testCase.err.Error())
+	}
+}
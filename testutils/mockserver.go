@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,12 +17,19 @@ var (
 	testLog       = testLogger.Sugar()
 )
 
+// MockNodeBackend is a mock execution node. Set the fields before serving requests, or use Reset and the
+// setters while requests are served (i.e. by the health checks).
 type MockNodeBackend struct {
+	lock sync.Mutex
+
 	LastRawRequest              *http.Request
 	LastJSONRPCRequest          *JSONRPCRequest
 	LastJSONRPCRequestTimestamp time.Time
 	RPCHandlerOverride          func(req *JSONRPCRequest) (result interface{}, err error)
 	HTTPHandlerOverride         func(w http.ResponseWriter, req *http.Request)
+
+	BlockNumber uint64 // returned by eth_blockNumber
+	Syncing     bool   // returned by eth_syncing
 }
 
 func NewMockNodeBackend() *MockNodeBackend {
@@ -29,18 +37,35 @@ func NewMockNodeBackend() *MockNodeBackend {
 }
 
 func (be *MockNodeBackend) Reset() {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+
 	be.LastRawRequest = nil
 	be.LastJSONRPCRequest = nil
 	be.LastJSONRPCRequestTimestamp = time.Time{}
 	be.RPCHandlerOverride = nil
 	be.HTTPHandlerOverride = nil
+	be.BlockNumber = 0
+	be.Syncing = false
+}
+
+// SetHTTPHandlerOverride replaces the handler of all requests, nil restores the default handler
+func (be *MockNodeBackend) SetHTTPHandlerOverride(handler func(w http.ResponseWriter, req *http.Request)) {
+	be.lock.Lock()
+	defer be.lock.Unlock()
+	be.HTTPHandlerOverride = handler
 }
 
 func (be *MockNodeBackend) handleRPCRequest(req *JSONRPCRequest) (result interface{}, err error) {
-	if be.RPCHandlerOverride != nil {
-		return be.RPCHandlerOverride(req)
+	be.lock.Lock()
+	rpcHandlerOverride := be.RPCHandlerOverride
+	be.lock.Unlock()
+	if rpcHandlerOverride != nil {
+		return rpcHandlerOverride(req)
 	}
 
+	be.lock.Lock()
+	defer be.lock.Unlock()
 	be.LastJSONRPCRequest = req
 
 	switch req.Method {
@@ -48,20 +73,32 @@ func (be *MockNodeBackend) handleRPCRequest(req *JSONRPCRequest) (result interfa
 		return "1", nil
 	case "eth_callBundle":
 		return "cool", nil
+	case "eth_blockNumber":
+		return fmt.Sprintf("0x%x", be.BlockNumber), nil
+	case "eth_syncing":
+		if be.Syncing {
+			return map[string]string{"currentBlock": fmt.Sprintf("0x%x", be.BlockNumber)}, nil
+		}
+		return false, nil
 	}
 
 	return "", fmt.Errorf("no RPC method handler implemented for %s", req.Method)
 }
 
 func (be *MockNodeBackend) Handler(w http.ResponseWriter, req *http.Request) {
-	if be.HTTPHandlerOverride != nil {
-		be.HTTPHandlerOverride(w, req)
+	be.lock.Lock()
+	httpHandlerOverride := be.HTTPHandlerOverride
+	be.lock.Unlock()
+	if httpHandlerOverride != nil {
+		httpHandlerOverride(w, req)
 		return
 	}
 
 	defer req.Body.Close()
+	be.lock.Lock()
 	be.LastRawRequest = req
 	be.LastJSONRPCRequestTimestamp = time.Now()
+	be.lock.Unlock()
 
 	testLog.Debugw("mockserver call", "remoteAddr", req.RemoteAddr, "method", req.Method, "url", req.URL)
 